@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Actions that can be requested through the user.s3agent.action extended attribute
+const (
+	// Send the file, or all the files of the directory, to remote right away
+	OFFLOAD_ACTION = "offload"
+
+	// Download the file, or all the files of the directory, right away
+	FETCH_ACTION = "fetch"
+)
+
+// The progress of a finished action is dropped once read, or after this delay if it never is
+const actionRetention = 10 * time.Minute
+
+var (
+	errActionRunning  = errors.New("An action is already running")
+	errActionNoSender = errors.New("The files cannot be offloaded without sender")
+)
+
+// Progress of an action started on a path
+type actionProgress struct {
+	action  string
+	total   int
+	done    int
+	failed  int
+	running bool
+
+	// set when the action finished
+	finishedAt time.Time
+}
+
+// Example: "offload running 3/10" / "fetch done 9/10 (1 failed)"
+func (p *actionProgress) String() string {
+	status := "done"
+	if p.running {
+		status = "running"
+	}
+
+	progress := fmt.Sprintf("%s %s %d/%d", p.action, status, p.done, p.total)
+	if p.failed > 0 {
+		progress += fmt.Sprintf(" (%d failed)", p.failed)
+	}
+
+	return progress
+}
+
+func parseAction(data []byte) (string, error) {
+	action := strings.ToLower(strings.TrimSpace(strings.TrimRight(string(data), "\x00")))
+	if action != OFFLOAD_ACTION && action != FETCH_ACTION {
+		return "", fmt.Errorf("Unknown action '%s'", action)
+	}
+
+	return action, nil
+}
+
+/// Offload or fetch the file, or all the files of the directory, in the background
+/// Only one action can run at a time on a path
+func (fs *S3FS) StartAction(path, action string) error {
+
+	fs.logger.Printf("Action: %v (%v)\n", path, action)
+
+	if action == OFFLOAD_ACTION && fs.sender == nil {
+		return fmt.Errorf("%w: '%s'", errActionNoSender, path)
+	}
+
+	fs.actionsMutex.Lock()
+	defer fs.actionsMutex.Unlock()
+
+	if progress, ok := fs.actions[path]; ok && progress.running {
+		return fmt.Errorf("%w: %s on '%s'", errActionRunning, progress.action, path)
+	}
+
+	// The progress of the actions nobody read
+	for actionPath, progress := range fs.actions {
+		if !progress.running && time.Since(progress.finishedAt) > actionRetention {
+			delete(fs.actions, actionPath)
+		}
+	}
+
+	// The files created since the last cycle must be in the DB to be found
+	fs.orm.FlushBatch()
+
+	pins := fs.orm.GetPins()
+	links := fs.orm.GetLinks()
+	toHandle := make([]S3NodeTable, 0)
+	for _, entry := range fs.orm.GetSubpathEntries(path) {
+		// Offloading local files or fetching remote ones
+		if entry.Local != (action == OFFLOAD_ACTION) {
+			continue
+		}
+
+		// Pinned files stay local whatever happens, whichever name is pinned
+		if action == OFFLOAD_ACTION && isPinned(pins, append([]string{entry.Path}, links[entry.UUID]...)...) {
+			continue
+		}
+
+		toHandle = append(toHandle, entry)
+	}
+
+	progress := &actionProgress{action: action, total: len(toHandle), running: true}
+	fs.actions[path] = progress
+
+	go func() {
+		for i := range toHandle {
+			var err error
+			if action == OFFLOAD_ACTION {
+				err = fs.sender.SendRemote(&toHandle[i])
+			} else {
+				err = fs.Download(toHandle[i].Path)
+			}
+
+			fs.actionsMutex.Lock()
+			if err != nil {
+				fs.logger.Printf("Error during %v of '%v': %v", action, toHandle[i].Path, err)
+				progress.failed++
+			} else {
+				progress.done++
+			}
+			fs.actionsMutex.Unlock()
+		}
+
+		fs.actionsMutex.Lock()
+		progress.running = false
+		progress.finishedAt = time.Now()
+		fs.actionsMutex.Unlock()
+	}()
+
+	return nil
+}
+
+/// Returns the progress of the last action started on the path, empty if there is none
+func (fs *S3FS) ActionProgress(path string) string {
+	fs.actionsMutex.Lock()
+	defer fs.actionsMutex.Unlock()
+
+	progress, ok := fs.actions[path]
+	if !ok {
+		return ""
+	}
+
+	return progress.String()
+}
+
+/// Drop the progress of the action on the path once it was read, unless it is still running
+func (fs *S3FS) ForgetAction(path string) {
+	fs.actionsMutex.Lock()
+	defer fs.actionsMutex.Unlock()
+
+	if progress, ok := fs.actions[path]; ok && !progress.running {
+		delete(fs.actions, path)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Delay between two attempts to send its rate to an upload, its remote control may not listen yet
+const bandwidthRetryDelay = 200 * time.Millisecond
+
+// Timeout of the requests sent to the remote control of an upload
+const bandwidthRequestTimeout = 2 * time.Second
+
+// The rate of an upload running, in bytes per second
+type bandwidthShare struct {
+	// the rclone of the rule sending the file, it gives the cap of the rule
+	owner *RClone
+
+	// address and credentials of the remote control of the rclone process
+	addr     string
+	password string
+
+	rate   int64
+	paused bool
+
+	// the last rate not sent to the process yet, closed with done when the upload ends
+	rates chan int64
+	done  chan bool
+}
+
+// Shares the bandwidth caps between the uploads running, whatever their rule
+// The cap of a rule is split between the uploads of the rule running, the global cap
+// between all the uploads running: a single upload gets the whole cap. The uploads a
+// rule cap slows down leave their part of the global cap to the others. The paused
+// uploads do not count. The shares are computed again each time an upload starts,
+// ends, is paused or resumed, and when a window changes the cap of a rule: the
+// rclone processes are told their new rate through their remote control.
+type bandwidthPool struct {
+	mutex  sync.Mutex
+	global int64
+	shares map[*bandwidthShare]bool
+}
+
+var uploadBandwidth = &bandwidthPool{shares: make(map[*bandwidthShare]bool)}
+
+// The --bwlimit argument of a rate, 0 is unlimited
+func formatRate(rate int64) string {
+	if rate == 0 {
+		return "off"
+	}
+	return fmt.Sprintf("%dB", rate)
+}
+
+// Register an upload of the rule before its process is started, the share holds its rate
+func (p *bandwidthPool) start(owner *RClone) (*bandwidthShare, error) {
+	addr, err := freeLocalAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	share := &bandwidthShare{
+		owner:    owner,
+		addr:     addr,
+		password: uuid.New().String(),
+		rates:    make(chan int64, 1),
+		done:     make(chan bool),
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.global, _ = parseSizeBytes(owner.config.Bandwidth)
+
+	// The process starts with its rate, it is not sent again
+	p.shares[share] = true
+	p.update()
+	select {
+	case <-share.rates:
+	default:
+	}
+
+	go share.post()
+	return share, nil
+}
+
+// Unregister the upload once its process exited, the others get its part of the caps
+func (p *bandwidthPool) finish(share *bandwidthShare) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.shares, share)
+	close(share.done)
+	p.update()
+}
+
+// Pause or resume the uploads of the rule, the paused ones leave their part of the global cap
+// The uploads must be resumed before their rate is sent, a stopped process never answers
+func (p *bandwidthPool) setPaused(owner *RClone, paused bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for share := range p.shares {
+		if share.owner == owner {
+			share.paused = paused
+		}
+	}
+	p.update()
+}
+
+// Compute the shares again, the caps of the rules depend on the upload windows
+func (p *bandwidthPool) Update() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.update()
+}
+
+// The mutex must be held
+func (p *bandwidthPool) update() {
+	now := time.Now()
+
+	running := make([]*bandwidthShare, 0, len(p.shares))
+	uploads := make(map[*RClone]int64)
+	for share := range p.shares {
+		if !share.paused {
+			running = append(running, share)
+			uploads[share.owner]++
+		}
+	}
+
+	// The part of the cap of its rule, 0 when the rule is not limited
+	limits := make([]int64, len(running))
+	for i, share := range running {
+		if ruleCap := share.owner.uploadCap(now); ruleCap > 0 {
+			limits[i] = ruleCap / uploads[share.owner]
+		}
+	}
+
+	for i, rate := range splitBandwidth(p.global, limits) {
+
+		// A cap smaller than the number of its uploads still limits them
+		if rate == 0 && (p.global > 0 || limits[i] > 0) {
+			rate = 1
+		}
+
+		if share := running[i]; rate != share.rate {
+			share.rate = rate
+			select {
+			case <-share.rates:
+			default:
+			}
+			share.rates <- rate
+		}
+	}
+}
+
+// Split the bandwidth evenly between the uploads, an upload never gets more than its limit
+// and the part it cannot use goes to the others, 0 is unlimited
+func splitBandwidth(bandwidth int64, limits []int64) []int64 {
+	rates := make([]int64, len(limits))
+	if bandwidth == 0 {
+		copy(rates, limits)
+		return rates
+	}
+
+	// The most limited uploads first, the unlimited ones last
+	order := make([]int, len(limits))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := limits[order[i]], limits[order[j]]
+		return a != 0 && (b == 0 || a < b)
+	})
+
+	left := bandwidth
+	for n, i := range order {
+		rate := left / int64(len(order)-n)
+		if limits[i] != 0 && limits[i] < rate {
+			rate = limits[i]
+		}
+		rates[i] = rate
+		left -= rate
+	}
+
+	return rates
+}
+
+// Send the rates of the share to its process until the upload ends, only the last one
+// when they change faster than the process answers
+func (share *bandwidthShare) post() {
+	client := &http.Client{Timeout: bandwidthRequestTimeout}
+	url := "http://" + share.addr + "/core/bwlimit"
+
+	for {
+		var rate int64
+		select {
+		case rate = <-share.rates:
+		case <-share.done:
+			return
+		}
+
+		for {
+			body := fmt.Sprintf(`{"rate": "%s"}`, formatRate(rate))
+			req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+			if err != nil {
+				share.owner.logger.Println("Cannot build the bandwidth request", err)
+				break
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.SetBasicAuth(rcloneRCUser, share.password)
+
+			resp, err := client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					break
+				}
+			}
+
+			select {
+			case rate = <-share.rates:
+			case <-time.After(bandwidthRetryDelay):
+			case <-share.done:
+				return
+			}
+		}
+	}
+}
+
+// A local address no process listens on, for the remote control of an upload
+func freeLocalAddr() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer listener.Close()
+	return listener.Addr().String(), nil
+}
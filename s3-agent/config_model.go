@@ -3,7 +3,14 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/exp/slices"
@@ -18,15 +25,26 @@ const (
 	// if the source is newer than X
 	NEWER_THAN = "NEWER_THAN"
 
+	// if the source was not read through the filesystem for X
+	// the last access is recorded by the agent itself, the loopback atime is not used
+	// Parameters example: "720h" (See https://pkg.go.dev/time#Duration)
+	NOT_ACCESSED_FOR = "NOT_ACCESSED_FOR"
+
 	// Send the file when larger than X
+	// Parameters example: "500Ko" / "100Mo" / "2Go" (units: o, Ko, Mo, Go, To)
 	LARGER_THAN = "LARGER_THAN"
 
 	// Send the file when smaller than X
+	// Parameters example: "500Ko" / "100Mo" / "2Go" (units: o, Ko, Mo, Go, To)
 	SMALLER_THAN = "SMALLER_THAN"
 
-	// User if the file is X
-	// Parameters example: "john"
+	// Send the file when its owner is X
+	// Parameters example: "john" / "1000" / "john,www-data" (user names or UIDs)
 	USER_IS = "USER_IS"
+
+	// Send the file when its group is X
+	// Parameters example: "staff" / "50" / "staff,adm" (group names or GIDs)
+	GROUP_IS = "GROUP_IS"
 )
 
 type RuleType string
@@ -40,12 +58,99 @@ type ValueTypeParamater struct {
 	Unit string `json:"unit"`
 }
 
+// Size units, each one is 1024 times the previous one
+var sizeUnits = map[string]int64{
+	"o":  1,
+	"Ko": 1 << 10,
+	"Mo": 1 << 20,
+	"Go": 1 << 30,
+	"To": 1 << 40,
+}
+
+var sizeRegexp = regexp.MustCompile(`^\s*(\d+)\s*([KMGT]?o)?\s*$`)
+
+// Parse a size parameter such as "100Mo" or "2Go"
+// A value without unit is a number of bytes
+func ParseSizeParameter(params string) (*ValueTypeParamater, error) {
+	match := sizeRegexp.FindStringSubmatch(params)
+	if match == nil {
+		return nil, fmt.Errorf("Invalid size '%s': expected a positive number followed by o, Ko, Mo, Go or To", params)
+	}
+
+	value, err := strconv.Atoi(match[1])
+	if err != nil {
+		return nil, err
+	}
+
+	unit := match[2]
+	if unit == "" {
+		unit = "o"
+	}
+
+	return &ValueTypeParamater{Value: value, Unit: unit}, nil
+}
+
+// Size in bytes of a size parameter
+func (param *ValueTypeParamater) Bytes() (int64, error) {
+	multiplier, ok := sizeUnits[param.Unit]
+	if !ok {
+		return -1, fmt.Errorf("Unknown size unit '%s'", param.Unit)
+	}
+
+	if param.Value < 0 {
+		return -1, fmt.Errorf("Size must be positive: %d", param.Value)
+	}
+
+	if int64(param.Value) > math.MaxInt64/multiplier {
+		return -1, fmt.Errorf("Size is too large: %d%s", param.Value, param.Unit)
+	}
+
+	return int64(param.Value) * multiplier, nil
+}
+
+// Size in bytes of a size parameter such as "100Mo", 0 when the parameter is empty
+func parseSizeBytes(params string) (int64, error) {
+	if params == "" {
+		return 0, nil
+	}
+
+	param, err := ParseSizeParameter(params)
+	if err != nil {
+		return -1, err
+	}
+
+	return param.Bytes()
+}
+
+// A node of a rule condition tree
+// A node is either a leaf (Type and Params) or exactly one of And, Or and Not
+// Example: {"and": [{"type": "OLDER_THAN", "params": "720h"}, {"not": {"type": "USER_IS", "params": "root"}}]}
+type RuleCondition struct {
+	// type of rule, must be in the elements above
+	Type RuleType `json:"type,omitempty"`
+
+	// paramaters for the rule
+	Params string `json:"params,omitempty"`
+
+	// all the sub-conditions must match
+	And []RuleCondition `json:"and,omitempty"`
+
+	// at least one of the sub-conditions must match
+	Or []RuleCondition `json:"or,omitempty"`
+
+	// the sub-condition must not match
+	Not *RuleCondition `json:"not,omitempty"`
+}
+
 type Rule struct {
 	// type of rule, must be in the elements above
-	Type RuleType `json:"type"`
+	Type RuleType `json:"type,omitempty"`
 
 	// paramaters for the rule
-	Params string `json:"params"`
+	Params string `json:"params,omitempty"`
+
+	// composite condition, replaces Type and Params
+	Condition *RuleCondition `json:"condition,omitempty"`
 
 	// source path: a folder in the local filesystem
 	// if the source is a file, apply the rule
@@ -57,15 +162,60 @@ type Rule struct {
 	Dest string `json:"dest"`
 
 	// Cron to send the values
-	// See Cron format: https://pkg.go.dev/github.com/robfig/cron
-	CronSender string `json:"cron-sender"`
+	// The files are sent as soon as they become eligible (See scheduler.go), the cron sweeps the others:
+	// each cycle reads all the local entries of the DB and checks the files the scheduler does not hold
+	// See Cron format: https://pkg.go.dev/github.com/robfig/cron / Default: "@hourly"
+	CronSender string `json:"cron-sender,omitempty"`
+
+	// gitignore-style patterns relative to the source
+	// when set, only the files matching one of the include patterns can be sent
+	// the files matching one of the exclude patterns always stay local
+	// `.s3ignore` files in the source tree add exclude patterns for their directory
+	// Example: ["*.mp4", "videos/"] / ["*.db", ".git/"]
+	IncludePatterns []string `json:"include-patterns,omitempty"`
+	ExcludePatterns []string `json:"exclude-patterns,omitempty"`
+
+	// Read remote files by ranges instead of downloading them on the first read
+	// the file is fully downloaded on write or once HydrateRatio of it was read
+	StreamReads bool `json:"stream-reads,omitempty"`
+
+	// Share of a streamed file, between 0 and 1, read before it is fully downloaded
+	// Default: 0.5
+	HydrateRatio float64 `json:"hydrate-ratio,omitempty"`
+
+	// Fetch in the background the blocks likely read next, needs stream-reads (See prefetch.go)
+	// Example: {"concurrency": 2, "depth": 4, "budget": "512Mo"}
+	Prefetch *PrefetchConfig `json:"prefetch,omitempty"`
+
+	// Files modified more recently than this duration are not sent yet, they are likely still written
+	// The files opened through the mountpoint are never sent
+	// Example: "30s" / Default: "0s"
+	SettleDelay string `json:"settle-delay,omitempty"`
+
+	// Keep the remote object of a recalled file, it is deleted once the file is local by default
+	// The file is truncated again without upload until it is modified through the mountpoint
+	// Deleting the file removes the object
+	Cache bool `json:"cache,omitempty"`
+
+	// Workers, bandwidth and budget of the send cycles (See sender.go)
+	// Example: {"concurrency": 8, "bandwidth": "10Mo", "budget": "50Go", "budget-files": 10000}
+	Upload *UploadConfig `json:"upload,omitempty"`
+
+	// Backoff and quarantine of the files failing to be sent (See retry.go)
+	// Example: {"max-attempts": 10, "backoff": "1m", "max-backoff": "24h"}
+	Retry *RetryConfig `json:"retry,omitempty"`
+
+	// Send the small files grouped in pack objects, they are sent by the cycles of the cron (See pack.go)
+	// Example: {"max-file-size": "1Mo", "size": "64Mo", "max-files": 1000, "garbage-ratio": 0.5}
+	Pack *PackConfig `json:"pack,omitempty"`
 }
 
 type Config struct {
-	Servers         []string                     `json:"servers"`          // servers to connect to
-	Rules           []Rule                       `json:"rules"`            // rules to apply
-	ExcludePatterns []string                     `json:"exclude-patterns"` // exclude files matching this paterns
-	RCloneConfig    map[string]map[string]string `json:"rclone-config"`    // Embedded rclone ini config
+	Servers         []string                     `json:"servers"`             // servers to connect to
+	Rules           []Rule                       `json:"rules"`               // rules to apply
+	ExcludePatterns []string                     `json:"exclude-patterns"`    // exclude files matching this paterns
+	RCloneConfig    map[string]map[string]string `json:"rclone-config"`       // Embedded rclone ini config
+	Bandwidth       string                       `json:"bandwidth,omitempty"` // bytes per second sent by all the rules, such as "10Mo"
 }
 
 // Load configuration from path
@@ -112,43 +262,345 @@ func (config *Config) IsValid() error {
 		if !slices.Contains(config.Servers, rule.Dest) {
 			return fmt.Errorf("Rule with source '%s': No server named '%s'", rule.Src, rule.Dest)
 		}
+
+		if err := rule.IsValid(); err != nil {
+			return fmt.Errorf("Rule with source '%s': %v", rule.Src, err)
+		}
 	}
 
 	if len(config.Servers) == 0 {
 		return fmt.Errorf("No server specified")
 	}
 
+	if _, err := parseSizeBytes(config.Bandwidth); err != nil {
+		return fmt.Errorf("Invalid bandwidth: %v", err)
+	}
+
 	if len(config.Rules) == 0 {
 		return fmt.Errorf("No rule specified")
 	}
 
-	if len(config.Rules) > 1 {
-		return fmt.Errorf("Only one rule is supported in this version, please upgrade by restarting the agent")
+	// Each rule has its own mountpoint
+	for i, rule := range config.Rules {
+		for _, other := range config.Rules[i+1:] {
+			if IsSubpath(rule.Src, other.Src, nil) || IsSubpath(other.Src, rule.Src, nil) {
+				return fmt.Errorf("Rules with sources '%s' and '%s' overlap", rule.Src, other.Src)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the condition tree of the rule
+// A rule without composite condition is a single leaf
+func (rule *Rule) GetCondition() *RuleCondition {
+	if rule.Condition != nil {
+		return rule.Condition
+	}
+
+	return &RuleCondition{Type: rule.Type, Params: rule.Params}
+}
+
+// Check that the rule condition can be evaluated
+func (rule *Rule) IsValid() error {
+	if rule.Condition != nil && (rule.Type != "" || rule.Params != "") {
+		return fmt.Errorf("A rule cannot have both a type and a condition")
+	}
+
+	if rule.HydrateRatio < 0 || rule.HydrateRatio > 1 {
+		return fmt.Errorf("Hydrate ratio must be between 0 and 1: %v", rule.HydrateRatio)
+	}
+
+	if rule.Prefetch != nil {
+		if !rule.StreamReads {
+			return fmt.Errorf("Prefetch needs stream-reads")
+		}
+		if err := rule.Prefetch.IsValid(); err != nil {
+			return err
+		}
+	}
+
+	if rule.Upload != nil {
+		if err := rule.Upload.IsValid(); err != nil {
+			return err
+		}
+	}
+
+	if rule.Retry != nil {
+		if err := rule.Retry.IsValid(); err != nil {
+			return err
+		}
+	}
+
+	if rule.Pack != nil {
+		if err := rule.Pack.IsValid(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := rule.GetSettleDelay(); err != nil {
+		return fmt.Errorf("Invalid settle delay: %v", err)
+	}
+
+	if _, err := parseIgnorePatterns(rule.IncludePatterns); err != nil {
+		return fmt.Errorf("Invalid include pattern: %v", err)
+	}
+
+	if _, err := parseIgnorePatterns(rule.ExcludePatterns); err != nil {
+		return fmt.Errorf("Invalid exclude pattern: %v", err)
+	}
+
+	return rule.GetCondition().IsValid()
+}
+
+func (rule *Rule) GetSettleDelay() (time.Duration, error) {
+	if rule.SettleDelay == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(rule.SettleDelay)
+}
+
+// Cron of the send cycles when the rule has none, the scheduler sends the files in between
+const defaultCronSender = "@hourly"
+
+func (rule *Rule) GetCronSender() string {
+	if rule.CronSender == "" {
+		return defaultCronSender
+	}
+	return rule.CronSender
+}
+
+// The entry is the one tracking the file in the DB, it can be nil when the file is not tracked
+func (rule *Rule) MustBeRemote(path string, entry *S3NodeTable) bool {
+	return rule.GetCondition().Evaluate(path, entry)
+}
+
+// When the rule sends the file if the file does not change meanwhile (See scheduler.go)
+// Returns false when it does not by itself, the cron of the rule catches the other cases
+func (rule *Rule) EligibleAt(path string, entry *S3NodeTable) (time.Time, bool) {
+	return rule.GetCondition().EligibleAt(path, entry, time.Now())
+}
+
+func (cond *RuleCondition) isLeaf() bool {
+	return cond.Type != ""
+}
+
+// Check that the condition is well formed, that the rule types exist and that their parameters can be parsed
+func (cond *RuleCondition) IsValid() error {
+
+	nbKinds := 0
+	for _, isSet := range []bool{cond.isLeaf(), cond.And != nil, cond.Or != nil, cond.Not != nil} {
+		if isSet {
+			nbKinds++
+		}
+	}
+
+	if nbKinds != 1 {
+		return fmt.Errorf("A condition must have exactly one of 'type', 'and', 'or' or 'not'")
+	}
+
+	switch {
+	case cond.And != nil, cond.Or != nil:
+		subConditions := cond.And
+		if cond.Or != nil {
+			subConditions = cond.Or
+		}
+		if len(subConditions) == 0 {
+			return fmt.Errorf("Empty 'and' or 'or' condition")
+		}
+		for i := range subConditions {
+			if err := subConditions[i].IsValid(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case cond.Not != nil:
+		return cond.Not.IsValid()
+	}
+
+	switch cond.Type {
+	case OLDER_THAN, NEWER_THAN, NOT_ACCESSED_FOR:
+		if _, err := time.ParseDuration(cond.Params); err != nil {
+			return fmt.Errorf("Invalid duration '%s': %v", cond.Params, err)
+		}
+	case LARGER_THAN, SMALLER_THAN:
+		param, err := ParseSizeParameter(cond.Params)
+		if err != nil {
+			return err
+		}
+		if _, err := param.Bytes(); err != nil {
+			return err
+		}
+	case USER_IS, GROUP_IS:
+		if _, err := resolveIDs(cond.Type, cond.Params); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Rule type '%s' not implemented", cond.Type)
 	}
 
 	return nil
 }
 
-func (rule *Rule) MustBeRemote(path string) bool {
+// Evaluate the condition on the file, sub-conditions are short-circuited
+func (cond *RuleCondition) Evaluate(path string, entry *S3NodeTable) bool {
 
-	switch rule.Type {
+	switch {
+	case cond.And != nil:
+		for i := range cond.And {
+			if !cond.And[i].Evaluate(path, entry) {
+				return false
+			}
+		}
+		return true
+	case cond.Or != nil:
+		for i := range cond.Or {
+			if cond.Or[i].Evaluate(path, entry) {
+				return true
+			}
+		}
+		return false
+	case cond.Not != nil:
+		return !cond.Not.Evaluate(path, entry)
+	}
+
+	switch cond.Type {
 	case OLDER_THAN:
-		return rule.olderThan(path)
+		return cond.olderThan(path)
 	case NEWER_THAN:
-		return rule.newerThan(path)
+		return cond.newerThan(path)
+	case NOT_ACCESSED_FOR:
+		return cond.notAccessedFor(path, entry)
+	case LARGER_THAN:
+		return cond.largerThan(path)
+	case SMALLER_THAN:
+		return cond.smallerThan(path)
+	case USER_IS:
+		return cond.userIs(path)
+	case GROUP_IS:
+		return cond.groupIs(path)
+	default:
+		panic(fmt.Errorf("Rule type '%s' not implemented", cond.Type))
+	}
+}
+
+// When the condition becomes true if the file does not change, now when it is true already
+// Only OLDER_THAN and NOT_ACCESSED_FOR become true with time, the other leaves are true now or never
+func (cond *RuleCondition) EligibleAt(path string, entry *S3NodeTable, now time.Time) (time.Time, bool) {
+
+	switch {
+	case cond.And != nil:
+		// The last sub-condition to become true
+		at := now
+		for i := range cond.And {
+			subAt, ok := cond.And[i].EligibleAt(path, entry, now)
+			if !ok {
+				return time.Time{}, false
+			}
+			if subAt.After(at) {
+				at = subAt
+			}
+		}
+		return at, true
+	case cond.Or != nil:
+		// The first sub-condition to become true
+		var at time.Time
+		found := false
+		for i := range cond.Or {
+			subAt, ok := cond.Or[i].EligibleAt(path, entry, now)
+			if ok && (!found || subAt.Before(at)) {
+				at, found = subAt, true
+			}
+		}
+		return at, found
+	}
+
+	switch cond.Type {
+	case OLDER_THAN, NOT_ACCESSED_FOR:
+		fo, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, false
+		}
+
+		// Validated by Config.IsValid
+		paramsDuration, _ := time.ParseDuration(cond.Params)
+
+		lastChange := fo.ModTime()
+		if cond.Type == NOT_ACCESSED_FOR && entry != nil && entry.LastAccess.After(lastChange) {
+			lastChange = entry.LastAccess
+		}
+
+		if at := lastChange.Add(paramsDuration); at.After(now) {
+			return at, true
+		}
+		return now, true
+	}
+
+	// The other leaves do not become true with time, the negations are only evaluated now
+	return now, cond.Evaluate(path, entry)
+}
+
+// Evaluate every sub-condition on the file and returns one line per node
+// describing its result, children are indented under their parent
+func (cond *RuleCondition) Explain(path string, entry *S3NodeTable) (bool, []string) {
+
+	var result bool
+	children := make([]string, 0)
+
+	explainAll := func(subConditions []RuleCondition, stopValue bool) bool {
+		found := false
+		for i := range subConditions {
+			subResult, lines := subConditions[i].Explain(path, entry)
+			children = append(children, lines...)
+			if subResult == stopValue {
+				found = true
+			}
+		}
+		return found
+	}
+
+	switch {
+	case cond.And != nil:
+		result = !explainAll(cond.And, false)
+	case cond.Or != nil:
+		result = explainAll(cond.Or, true)
+	case cond.Not != nil:
+		result = !explainAll([]RuleCondition{*cond.Not}, true)
 	default:
-		panic(fmt.Errorf("Rule type '%s' not implemented", rule.Type))
+		result = cond.Evaluate(path, entry)
+	}
+
+	lines := []string{fmt.Sprintf("%v -> %v", cond, result)}
+	for _, line := range children {
+		lines = append(lines, "    "+line)
 	}
+
+	return result, lines
 }
 
-func (rule *Rule) olderThan(path string) bool {
+func (cond *RuleCondition) String() string {
+	switch {
+	case cond.And != nil:
+		return "AND"
+	case cond.Or != nil:
+		return "OR"
+	case cond.Not != nil:
+		return "NOT"
+	default:
+		return fmt.Sprintf("%s(%s)", cond.Type, cond.Params)
+	}
+}
+
+func (cond *RuleCondition) olderThan(path string) bool {
 
 	fo, err := os.Stat(path)
 	if err != nil {
 		return false
 	}
 
-	paramsDuration, err := time.ParseDuration(rule.Params)
+	paramsDuration, err := time.ParseDuration(cond.Params)
 	if err != nil {
 		return false
 	}
@@ -157,14 +609,14 @@ func (rule *Rule) olderThan(path string) bool {
 	return paramsDuration <= fileModDuration
 }
 
-func (rule *Rule) newerThan(path string) bool {
+func (cond *RuleCondition) newerThan(path string) bool {
 
 	fo, err := os.Stat(path)
 	if err != nil {
 		return false
 	}
 
-	paramsDuration, err := time.ParseDuration(rule.Params)
+	paramsDuration, err := time.ParseDuration(cond.Params)
 	if err != nil {
 		return false
 	}
@@ -172,3 +624,198 @@ func (rule *Rule) newerThan(path string) bool {
 	fileModDuration := time.Now().Sub(fo.ModTime())
 	return paramsDuration >= fileModDuration
 }
+
+func (cond *RuleCondition) notAccessedFor(path string, entry *S3NodeTable) bool {
+
+	fo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	paramsDuration, err := time.ParseDuration(cond.Params)
+	if err != nil {
+		return false
+	}
+
+	// A write is an access too, and files tracked before the agent recorded
+	// accesses only have their modification time
+	lastAccess := fo.ModTime()
+	if entry != nil && entry.LastAccess.After(lastAccess) {
+		lastAccess = entry.LastAccess
+	}
+
+	return paramsDuration <= time.Now().Sub(lastAccess)
+}
+
+func (cond *RuleCondition) paramsSize() (int64, error) {
+	param, err := ParseSizeParameter(cond.Params)
+	if err != nil {
+		return -1, err
+	}
+
+	return param.Bytes()
+}
+
+func (cond *RuleCondition) largerThan(path string) bool {
+
+	fo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	paramsSize, err := cond.paramsSize()
+	if err != nil {
+		return false
+	}
+
+	return paramsSize <= fo.Size()
+}
+
+func (cond *RuleCondition) smallerThan(path string) bool {
+
+	fo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	paramsSize, err := cond.paramsSize()
+	if err != nil {
+		return false
+	}
+
+	return paramsSize >= fo.Size()
+}
+
+// Resolve a comma separated list of names or numeric ids with the given lookup function
+func parseIDs(params string, lookup func(name string) (string, error)) ([]uint32, error) {
+	ids := make([]uint32, 0)
+
+	for _, name := range strings.Split(params, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		// Numeric ids do not need to exist on the system
+		if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+			ids = append(ids, uint32(id))
+			continue
+		}
+
+		idStr, err := lookup(name)
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, uint32(id))
+	}
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No user or group specified in '%s'", params)
+	}
+
+	return ids, nil
+}
+
+func parseUserIDs(params string) ([]uint32, error) {
+	return parseIDs(params, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+}
+
+func parseGroupIDs(params string) ([]uint32, error) {
+	return parseIDs(params, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+}
+
+// The ids of the USER_IS and GROUP_IS parameters, resolved when the config is validated
+// The name lookups go through NSS, they are too slow to run for each file of each cycle.
+// A user or group renamed or created after the config was loaded needs a restart.
+var resolvedIDs = struct {
+	sync.Mutex
+	ids map[string][]uint32
+}{ids: make(map[string][]uint32)}
+
+func resolveIDs(ruleType RuleType, params string) ([]uint32, error) {
+	key := string(ruleType) + ":" + params
+
+	resolvedIDs.Lock()
+	defer resolvedIDs.Unlock()
+
+	if ids, ok := resolvedIDs.ids[key]; ok {
+		return ids, nil
+	}
+
+	parse := parseUserIDs
+	if ruleType == GROUP_IS {
+		parse = parseGroupIDs
+	}
+
+	ids, err := parse(params)
+	if err != nil {
+		return nil, err
+	}
+
+	resolvedIDs.ids[key] = ids
+	return ids, nil
+}
+
+// Returns the owner and the group of the file, the path must be the loopback one
+// or the mountpoint one since the FUSE layer forwards the loopback ownership
+func fileOwner(path string) (uint32, uint32, error) {
+	fo, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	st, ok := fo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, fmt.Errorf("Cannot read the owner of '%s'", path)
+	}
+
+	return st.Uid, st.Gid, nil
+}
+
+func (cond *RuleCondition) userIs(path string) bool {
+
+	uid, _, err := fileOwner(path)
+	if err != nil {
+		return false
+	}
+
+	uids, err := resolveIDs(USER_IS, cond.Params)
+	if err != nil {
+		return false
+	}
+
+	return slices.Contains(uids, uid)
+}
+
+func (cond *RuleCondition) groupIs(path string) bool {
+
+	_, gid, err := fileOwner(path)
+	if err != nil {
+		return false
+	}
+
+	gids, err := resolveIDs(GROUP_IS, cond.Params)
+	if err != nil {
+		return false
+	}
+
+	return slices.Contains(gids, gid)
+}
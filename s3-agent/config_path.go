@@ -90,6 +90,20 @@ func (c *ConfigPath) GetLoopbackFSPath(uuid string) string {
 	return ruleFolder
 }
 
+// Folder of the recalled files until they are verified and moved into their loopback
+// It is next to the loopbacks so that the files are moved by a rename
+func (c *ConfigPath) GetStagingPath() string {
+	stagingFolder := filepath.Join(c.folder, "staging")
+
+	if !IsDirectory(stagingFolder) {
+		if err := os.Mkdir(stagingFolder, 0700); err != nil {
+			panic(err)
+		}
+	}
+
+	return stagingFolder
+}
+
 func getConfigDir() string {
 
 	home := ""
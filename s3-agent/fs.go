@@ -1,11 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
-	"os/signal"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
 	fuseFs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -19,34 +22,69 @@ type S3FS struct {
 	/// Path of the mountpoint
 	mountPath string
 
-	/// All file handle by paths
+	/// Rule applied on the mountpoint
+	rule *Rule
+
+	/// All file handle by paths, guarded by mutex
 	fhmap  map[string][]*S3File
 	mutex  sync.Mutex
 	logger *log.Logger
 
+	/// Paths committed by whileClosed, their new file handles wait for committed, guarded by mutex
+	committing map[string]int
+	committed  *sync.Cond
+
+	/// Paths being opened, counted as open until their handle is registered, guarded by mutex
+	opening map[string]int
+
+	/// Uploads and downloads of the files, one at a time per file (See state.go)
+	states *stateMachine
+
 	config *ConfigPath
 
 	server *fuse.Server
 	rclone *RClone
 	orm    *SQlite
-	done   chan bool
+
+	/// Sender of the rule, used by the offload action
+	sender *S3Sender
+
+	/// Progress of the actions by paths
+	actions      map[string]*actionProgress
+	actionsMutex sync.Mutex
+
+	/// Blocks cached by the ranged reads by paths (See stream.go)
+	streams      map[string]*blockCache
+	streamsMutex sync.Mutex
+
+	/// Background recalls of the files read next, nil if disabled (See prefetch.go)
+	prefetcher *Prefetcher
 }
 
-func NewS3FS(loopbackPath, mountPath string, config *ConfigPath, orm *SQlite) *S3FS {
-	return &S3FS{
+func NewS3FS(loopbackPath, mountPath string, rule *Rule, config *ConfigPath, orm *SQlite) *S3FS {
+	fs := &S3FS{
 		loopbackPath: loopbackPath,
 		mountPath:    mountPath,
+		rule:         rule,
 		fhmap:        make(map[string][]*S3File),
+		committing:   make(map[string]int),
+		opening:      make(map[string]int),
+		states:       newStateMachine(),
+		actions:      make(map[string]*actionProgress),
+		streams:      make(map[string]*blockCache),
 		logger:       config.NewLogger("FUSE: " + mountPath + " | "),
 		config:       config,
 		rclone:       NewRClone(config),
-		done:         make(chan bool),
 		orm:          orm,
 	}
+
+	fs.committed = sync.NewCond(&fs.mutex)
+	fs.prefetcher = NewPrefetcher(fs, rule)
+	return fs
 }
 
-/// We want to run this function in a goroutine
 /// This function manages 1 Rule for 1 mountpoint
+/// The FUSE server is served in its own goroutine until Stop is called
 func (fs *S3FS) Run(debug bool) error {
 
 	if err := os.Mkdir(fs.mountPath, 0755); err != nil {
@@ -79,18 +117,12 @@ func (fs *S3FS) Run(debug bool) error {
 		fs.logger.Panicln(err)
 	}
 
-	fs.catchSignals()
-
 	fs.server = server
 	go fs.server.Wait()
 
 	return nil
 }
 
-func (fs *S3FS) WaitStop() {
-	<-fs.done
-}
-
 func (fs *S3FS) Stop() error {
 	err := fs.server.Unmount()
 	if err != nil {
@@ -101,67 +133,136 @@ func (fs *S3FS) Stop() error {
 		fs.logger.Printf("Error removing root filesystem node '%v': %v", fs.mountPath, err)
 	}
 
-	fs.done <- true
-
 	return err
 }
 
-/// We have 7 Hooks on the Fuse calls
-/// 1. Rename        -> Rename entry in the DB
-/// 2. Unlink        -> Remove entry from the DB + if remote, remove the file from the S3
+/// We have 20 Hooks on the Fuse calls
+/// 1. Rename        -> Prepare the remote files of the file or the directory to be renamed
+/// 2. Unlink        -> Remove entry from the DB + if remote, remove the file from the S3 (last name only)
 /// 3. Download      -> The user needs the bytes in the file
 /// 4. GetSize       -> We need the replace the size of the file with the one from the S3
 /// 5. Create        -> Create a new file in the DB and register the file handler
 /// 6. RegisterFH    -> Register the file handle to the list of file handle related to the file
 /// 7. UnregisterFH  -> Unregister the file handle
-
-/// Rename entry in the DB
+/// 8. Access        -> Record that the user read the file
+/// 9. Pin           -> Pin or unpin a file or a directory, recall the pinned remote files
+/// 10. Rmdir        -> Remove the pins and the entries of the directory
+/// 11. StateXattrs  -> Describe the offload state of the file
+/// 12. StartAction  -> Offload or fetch a file or a directory right away (see actions.go)
+/// 13. ReadRange    -> The user needs some bytes of the file (see stream.go)
+/// 14. Opened       -> Prefetch the files likely opened next (see prefetch.go)
+/// 15. Renamed      -> Move the entries of the renamed file or directory in the DB
+/// 16. Exchange     -> Swap the entries of the exchanged files or directories in the DB
+/// 17. Link         -> Register the new name of a tracked file in the DB
+/// 18. Modified     -> The content of the file is about to change, its cached remote copy is outdated
+/// 19. Closed       -> The file created or written through a handle was closed, schedule its offload (see scheduler.go)
+/// 20. Truncated    -> The file is truncated by its open, its remote content is dropped instead of downloaded
+
+/// Called before the rename of a file or a directory
 func (fs *S3FS) Rename(oldPath, newPath string) error {
 
 	fs.logger.Printf("Rename: %v -> %v\n", oldPath, newPath)
 
-	// If the path does not point to a file, then we don't treat it
-	if !IsRegFile(oldPath) {
-		return nil
+	// The objects of the files uploaded by an older version are keyed by their path,
+	// they must be moved to their stable key before the path of the files changes
+	for _, entry := range fs.orm.GetLegacyEntries(oldPath) {
+		objectKey, err := fs.rclone.MigrateObject(&entry)
+		if err != nil {
+			fs.logger.Println("Error migrating the remote object", err)
+			return err
+		}
+		fs.orm.SetObjectKey(&entry, objectKey)
+
+		if err := setUUIDXattr(entry.Path, entry.UUID); err != nil {
+			fs.logger.Println("Error keeping the UUID of the file", err)
+		}
 	}
 
-	// The file does not need to be tracked or is local
-	if fs.orm.IsEntryLocal(oldPath) {
-		return nil
+	return nil
+}
+
+/// Move the entries of the renamed file or directory and of its children
+/// The ones of the replaced file or directory are removed, with their remote files
+func (fs *S3FS) Renamed(oldPath, newPath string) error {
+
+	fs.logger.Printf("Renamed: %v -> %v\n", oldPath, newPath)
+
+	fs.forgetStreams(oldPath)
+	fs.forgetStreams(newPath)
+	fs.prefetcher.Forget(oldPath)
+
+	fs.orm.DeletePins(newPath)
+	fs.orm.RenamePins(oldPath, newPath)
+
+	replaced, err := fs.orm.RenameEntries(oldPath, newPath)
+	if err != nil {
+		fs.logger.Printf("Error renaming the entries: %v", err)
+		return err
+	}
+
+	fs.removeRemote(replaced)
+	fs.scheduler().Renamed(oldPath, newPath)
+	return nil
+}
+
+/// Swap the entries of the exchanged files or directories and of their children
+func (fs *S3FS) Exchange(path1, path2 string) error {
+
+	fs.logger.Printf("Exchange: %v <-> %v\n", path1, path2)
+
+	fs.forgetStreams(path1)
+	fs.forgetStreams(path2)
+	fs.prefetcher.Forget(path1)
+	fs.prefetcher.Forget(path2)
+	fs.scheduler().Exchange(path1, path2)
+
+	fs.orm.ExchangePins(path1, path2)
+
+	if err := fs.orm.ExchangeEntries(path1, path2); err != nil {
+		fs.logger.Printf("Error exchanging the entries: %v", err)
+		return err
 	}
 
-	fs.orm.RenameEntry(oldPath, newPath)
 	return nil
 }
 
 /// Remove entry from the DB + if remote, remove the file from the S3
+/// A file linked more than once only loses the name until its last name is removed
 func (fs *S3FS) Unlink(path string) error {
 
 	fs.logger.Printf("Unlink: %v\n", path)
 
+	fs.orm.DeletePins(path)
+
 	// If the path does not point to a file, then we don't treat it
 	if !IsRegFile(path) {
 		return nil
 	}
 
-	var entries []S3NodeTable
-	fs.orm.db.Where("Path = ?", path).Limit(1).Find(&entries)
+	// The remote file is removed with the last name of the file only
+	fs.forgetStreams(path)
+	fs.scheduler().Forget(path)
+	fs.removeRemote(fs.orm.DeleteEntries(path))
+
+	return nil
+}
+
+/// Register the new name of a tracked file
+func (fs *S3FS) Link(targetPath, path string) error {
+
+	fs.logger.Printf("Link: %v -> %v\n", path, targetPath)
+
+	// The target may have been created since the last cycle
+	fs.orm.FlushBatch()
+
+	entry := fs.orm.GetEntry(fs.mountPath, targetPath, 0)
 
 	// The file does not need to be tracked
-	if len(entries) == 0 {
+	if entry == nil {
 		return nil
 	}
 
-	if !entries[0].Local {
-		if err := fs.rclone.Remove(&entries[0]); err != nil {
-			fs.logger.Printf("Error removing the local file: %v", err)
-			return nil
-		}
-	}
-
-	fs.orm.DeleteEntry(&entries[0])
-
-	return nil
+	return fs.orm.AddLink(entry, path)
 }
 
 /// We add the entry to the DB and we register the file handle
@@ -180,7 +281,10 @@ func (fs *S3FS) Create(fh *S3File) error {
 		return nil
 	}
 
-	fs.orm.batch = append(fs.orm.batch, fs.orm.GetNewEntry(fs.mountPath, fh.Path, stat.Size()))
+	fs.orm.AddToBatch(fs.orm.GetNewEntry(fs.mountPath, fh.Path, stat.Size()))
+
+	// Scheduled once the handle is released, even if nothing is written
+	fh.written = true
 	return fs.RegisterFH(fh)
 }
 
@@ -206,22 +310,282 @@ func (fs *S3FS) Download(path string) error {
 		return nil
 	}
 
-	// Lock all file handle related to the file
-	fs.lockFHs(path)
-	defer fs.unlockFHs(path)
+	// The concurrent recalls of the file wait for the first one
+	err := fs.states.Transition(entry.UUID, DOWNLOADING_STATE, true, func() error {
+
+		// Another transition may have run in the meantime
+		entry := fs.orm.GetEntry(fs.mountPath, path, 0)
+		if entry == nil || entry.Local {
+			return nil
+		}
+
+		// Lock all file handle related to the file, the handles opened meanwhile
+		// are registered once the file is replaced
+		names := fs.orm.GetNames(entry)
+		fs.beginCommit(names)
+		defer fs.endCommit(names)
+		fhs := fs.lockFHs(names)
+		defer fs.unlockFHs(fhs)
+
+		// The loopback file is only replaced by a complete and verified copy,
+		// a failed download leaves the file remote with its object on the server
+		stagingPath := filepath.Join(fs.config.GetStagingPath(), entry.UUID)
+		defer os.Remove(stagingPath)
+
+		objectKey, err := fs.rclone.GetObjectKey(entry)
+		if err != nil {
+			return err
+		}
+
+		// A crash until the object is removed is replayed on the next start
+		keepRemote := fs.rule != nil && fs.rule.Cache
+		intent := newDownloadIntent(entry, objectKey, keepRemote)
+		if err := fs.orm.BeginIntent(intent); err != nil {
+			return err
+		}
+		defer fs.orm.EndIntent(intent)
+
+		if err := fs.rclone.Download(entry, stagingPath); err != nil {
+			fs.logger.Println("Error while downloading the file", err)
+			return err
+		}
+
+		if err := verifyRecall(entry, stagingPath); err != nil {
+			fs.logger.Println("Error while verifying the downloaded file", err)
+			return err
+		}
+
+		// The streamed blocks are replaced with the rest of the file
+		cachedBlocks := hasCachedBlocks(entry.Path)
+
+		if err := fs.replaceFile(stagingPath, names); err != nil {
+			fs.logger.Println("Error while moving the downloaded file in place", err)
+			return err
+		}
+
+		if cachedBlocks {
+			fs.dropBlockCache(entry.Path)
+		}
+
+		// The handles still point to the replaced file
+		if err := fs.reloadFds(fhs); err != nil {
+			fs.logger.Println("Error while reopening the downloaded file", err)
+		}
+
+		fs.orm.RetriveFromServer(entry, keepRemote)
+
+		// The range of a packed file is reclaimed by the repack command
+		if !keepRemote && entry.PackID == "" {
+			if err := fs.rclone.RemoveObject(entry.Server, objectKey); err != nil {
+				fs.logger.Println("Error removing the remote file", err)
+			}
+		}
+
+		return nil
+	})
+
+	// The failed recalls are only reported by the status command, the reads always try again
+	if err != nil {
+		fs.orm.RecordFailure(entry, DOWNLOAD_INTENT, err, nil)
+	} else {
+		fs.orm.ClearFailures(entry.UUID, DOWNLOAD_INTENT)
+	}
+	return err
+}
+
+/// Called before an open truncates the file, the remote content is dropped instead of downloaded
+/// The file becomes local and empty, the object is only kept by the cache mode to be overwritten
+func (fs *S3FS) Truncated(path string) error {
+
+	fs.logger.Printf("Truncated: %v\n", path)
+
+	if !IsRegFile(path) {
+		return nil
+	}
+
+	entry := fs.orm.GetEntry(fs.mountPath, path, 0)
+	if entry == nil || entry.Local {
+		return nil
+	}
+
+	return fs.states.Transition(entry.UUID, DOWNLOADING_STATE, true, func() error {
+
+		// Another transition may have run in the meantime
+		entry := fs.orm.GetEntry(fs.mountPath, path, 0)
+		if entry == nil || entry.Local {
+			return nil
+		}
+
+		fhs := fs.lockFHs(fs.orm.GetNames(entry))
+		defer fs.unlockFHs(fhs)
+
+		objectKey, err := fs.rclone.GetObjectKey(entry)
+		if err != nil {
+			return err
+		}
+
+		// A crash before the entry is local leaves the empty file remote, its next open recalls it
+		keepRemote := fs.rule != nil && fs.rule.Cache
+		intent := newDownloadIntent(entry, objectKey, keepRemote)
+		if err := fs.orm.BeginIntent(intent); err != nil {
+			return err
+		}
+		defer fs.orm.EndIntent(intent)
+
+		if err := os.Truncate(entry.Path, 0); err != nil {
+			return err
+		}
+		if hasCachedBlocks(entry.Path) {
+			fs.dropBlockCache(entry.Path)
+		}
+
+		fs.orm.RetriveFromServer(entry, keepRemote)
+
+		if !keepRemote && entry.PackID == "" {
+			if err := fs.rclone.RemoveObject(entry.Server, objectKey); err != nil {
+				fs.logger.Println("Error removing the remote file", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+/// Check the downloaded copy of the file against the checksum of the uploaded one
+/// Only the size is checked for the files uploaded before the checksums were kept
+func verifyRecall(entry *S3NodeTable, stagingPath string) error {
+	info, err := os.Stat(stagingPath)
+	if err != nil {
+		return err
+	}
+
+	if info.Size() != entry.Size {
+		return fmt.Errorf("Downloaded %d bytes instead of %d for %s", info.Size(), entry.Size, entry.Path)
+	}
+
+	if entry.Checksum == "" {
+		return nil
+	}
+
+	checksum, err := fileMD5(stagingPath)
+	if err != nil {
+		return err
+	}
+
+	if checksum != entry.Checksum {
+		return fmt.Errorf("Downloaded checksum %s instead of %s for %s", checksum, entry.Checksum, entry.Path)
+	}
+
+	return nil
+}
+
+/// Move the downloaded file in place of the truncated one under all its names
+/// It takes the owner, the permissions and the extended attributes of the truncated file
+func (fs *S3FS) replaceFile(stagingPath string, names []string) error {
+	var stat syscall.Stat_t
+	if err := syscall.Lstat(names[0], &stat); err != nil {
+		return err
+	}
+
+	if err := os.Lchown(stagingPath, int(stat.Uid), int(stat.Gid)); err != nil {
+		fs.logger.Println("Cannot keep the owner of the file", err)
+	}
+
+	if err := os.Chmod(stagingPath, os.FileMode(stat.Mode&07777)); err != nil {
+		return err
+	}
+
+	if err := copyXattrs(names[0], stagingPath); err != nil {
+		return err
+	}
+
+	if err := os.Rename(stagingPath, names[0]); err != nil {
+		return err
+	}
+
+	return linkNames(stagingPath, names)
+}
 
-	if err := fs.rclone.Download(entry); err != nil {
-		fs.logger.Println("Error while downloading the file", err)
+/// Link the other names of the file to the one of its entry, one by one through stagingPath
+func linkNames(stagingPath string, names []string) error {
+	info, err := os.Lstat(names[0])
+	if err != nil {
 		return err
 	}
 
-	// Maybe flock the file but not sure if rclone will work as it will be a child process
+	for _, name := range names[1:] {
+		if other, err := os.Lstat(name); err == nil && os.SameFile(info, other) {
+			continue
+		}
 
-	fs.orm.RetriveFromServer(entry)
+		if err := os.Link(names[0], stagingPath); err != nil {
+			return err
+		}
+		if err := os.Rename(stagingPath, name); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+/// The user needs the bytes in [off, off+size) of the file
+/// Remote files are downloaded, unless the rule streams the reads: only the range is fetched then
+func (fs *S3FS) ReadRange(path string, off int64, size int) error {
+
+	if fs.rule == nil || !fs.rule.StreamReads {
+		return fs.Download(path)
+	}
+
+	// If the path does not point to a file, then we don't treat it
+	if !IsRegFile(path) {
+		return nil
+	}
+
+	entry := fs.orm.GetEntry(fs.mountPath, path, 0)
+
+	// The file does not need to be tracked or the file is local
+	if entry == nil || entry.Local {
+		return nil
+	}
+
+	hydrate, err := fs.streamRemote(entry, off, size)
+	if err != nil {
+		return err
+	}
+
+	// Most of the file is read, keeping it is cheaper than fetching the remaining blocks one by one
+	if hydrate {
+		fs.logger.Printf("Hydrating streamed file: %v\n", entry.Path)
+		return fs.Download(path)
+	}
+
+	fs.prefetcher.Read(entry, off, size)
+	return nil
+}
+
+/// Fetch the blocks of the remote file with ranged reads, returns true once the file should be downloaded
+/// The downloads of the file wait for the running ranged reads
+func (fs *S3FS) streamRemote(entry *S3NodeTable, off int64, size int) (hydrate bool, err error) {
+	err = fs.states.Read(entry.UUID, func() error {
+
+		// A download may have run in the meantime
+		entry := fs.orm.GetEntry(fs.mountPath, entry.Path, 0)
+		if entry == nil || entry.Local {
+			return nil
+		}
+
+		hydrate, err = fs.streamRange(entry, off, size)
+		return err
+	})
+	return hydrate, err
+}
+
+/// Prefetch the files likely opened next
+func (fs *S3FS) Opened(path string) {
+	fs.prefetcher.Opened(path)
+}
+
 func (fs *S3FS) GetSize(path string) (int64, error) {
 
 	fs.logger.Printf("GetSize: %v\n", path)
@@ -248,6 +612,118 @@ func (fs *S3FS) GetSize(path string) (int64, error) {
 
 }
 
+/// Called before the content of the file changes
+/// The remote copy kept by the cache mode no longer matches the file, it must be sent again
+/// The flag is written right away, a crash must not leave a modified file clean
+func (fs *S3FS) Modified(path string) error {
+	return fs.orm.MarkDirty(path)
+}
+
+/// Queue the offload of the file, the rule may send it once its last handle is closed
+func (fs *S3FS) Closed(path string) {
+	fs.scheduler().Schedule(path)
+}
+
+/// The offload scheduler of the rule, nil if the rule only sends files on its cycles
+func (fs *S3FS) scheduler() *OffloadScheduler {
+	if fs.sender == nil {
+		return nil
+	}
+	return fs.sender.scheduler
+}
+
+/// Record the access in the DB, the loopback atime is not reliable (noatime mounts)
+func (fs *S3FS) Access(path string) {
+	fs.orm.RecordAccess(path)
+}
+
+/// Pin or unpin a file or a directory
+/// The remote files under a new pin are recalled in the background
+/// Unpinning a file does not unpin it if one of its parents is pinned
+func (fs *S3FS) Pin(path string, pinned bool) error {
+
+	fs.logger.Printf("Pin: %v (%v)\n", path, pinned)
+
+	if !pinned {
+		return fs.orm.Unpin(path)
+	}
+
+	if err := fs.orm.Pin(path); err != nil {
+		return err
+	}
+
+	toRecall := make([]string, 0)
+	for _, entry := range fs.orm.GetSubpathEntries(path) {
+		if !entry.Local {
+			toRecall = append(toRecall, entry.Path)
+		}
+	}
+
+	go func() {
+		for _, entryPath := range toRecall {
+			if err := fs.Download(entryPath); err != nil {
+				fs.logger.Printf("Error while recalling pinned file '%v': %v", entryPath, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+/// Remove the pins of the directory and the entries left under it
+func (fs *S3FS) Rmdir(path string) error {
+
+	fs.logger.Printf("Rmdir: %v\n", path)
+
+	fs.orm.DeletePins(path)
+	fs.removeRemote(fs.orm.DeleteEntries(path))
+	return nil
+}
+
+/// Remove the remote files of entries whose files do not exist anymore
+func (fs *S3FS) removeRemote(entries []S3NodeTable) {
+	for i := range entries {
+		fs.prefetcher.Forget(entries[i].Path)
+		fs.scheduler().Forget(entries[i].Path)
+		fs.orm.ClearFailures(entries[i].UUID)
+
+		// The recalled files may keep their remote object
+		if entries[i].Server != "" {
+			if err := fs.rclone.Remove(&entries[i]); err != nil {
+				fs.logger.Printf("Error removing the remote file: %v", err)
+			}
+		}
+	}
+}
+
+/// Returns the values of the virtual attributes of the file, nil if the file is not tracked
+/// The remote attributes are only set for remote files
+func (fs *S3FS) StateXattrs(path string) map[string]string {
+
+	entry := fs.orm.GetEntry(fs.mountPath, path, 0)
+	if entry == nil {
+		return nil
+	}
+
+	state := fs.states.State(entry)
+	if entry.Local {
+		return map[string]string{stateXattr: state.String()}
+	}
+
+	xattrs := map[string]string{
+		stateXattr:      state.String(),
+		serverXattr:     entry.Server,
+		remoteSizeXattr: strconv.FormatInt(entry.Size, 10),
+		uploadedAtXattr: entry.UploadedAt.Format(time.RFC3339),
+	}
+
+	if key, err := fs.rclone.GetObjectKey(entry); err == nil {
+		xattrs[objectKeyXattr] = key
+	}
+
+	return xattrs
+}
+
 func (fs *S3FS) RegisterFH(fh *S3File) error {
 
 	fs.logger.Printf("RegisterFH: %v\n", fh)
@@ -260,6 +736,16 @@ func (fs *S3FS) RegisterFH(fh *S3File) error {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
 
+	// The file is being truncated or replaced, the handle is reopened once it is done
+	if fs.committing[fh.Path] > 0 {
+		for fs.committing[fh.Path] > 0 {
+			fs.committed.Wait()
+		}
+		if err := reopenFH(fh); err != nil {
+			return err
+		}
+	}
+
 	// Check that we don't have already the file handle in the map
 	// If we do, and we don't check this we will lock twice the same mutex
 	// and we will have a deadlock
@@ -295,56 +781,141 @@ func (fs *S3FS) UnregisterFH(fh *S3File) error {
 
 	if len(fs.fhmap[fh.Path]) == 1 {
 		delete(fs.fhmap, fh.Path)
+		fs.prefetcher.Forget(fh.Path)
 	} else {
-		fs.fhmap[fh.Path] = slices.Delete(fs.fhmap[fh.Path], index, index+2)
+		fs.fhmap[fh.Path] = slices.Delete(fs.fhmap[fh.Path], index, index+1)
 	}
 
 	return nil
 }
 
-func (fs *S3FS) lockFHs(path string) {
-	for _, fh := range fs.fhmap[path] {
+/// Is one of the paths opened through the mountpoint
+func (fs *S3FS) hasOpenFHs(paths []string) bool {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.hasOpenFHsLocked(paths)
+}
+
+// The mutex must be held
+func (fs *S3FS) hasOpenFHsLocked(paths []string) bool {
+	for _, path := range paths {
+		if len(fs.fhmap[path]) > 0 || fs.opening[path] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+/// Hold the path open until endOpen, once the commits running on it are done
+/// The handle opened meanwhile must be registered before endOpen, no commit runs in between
+func (fs *S3FS) beginOpen(path string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	for fs.committing[path] > 0 {
+		fs.committed.Wait()
+	}
+	fs.opening[path]++
+}
+
+func (fs *S3FS) endOpen(path string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.opening[path]--; fs.opening[path] == 0 {
+		delete(fs.opening, path)
+	}
+}
+
+/// Run commit if none of the paths is open, the paths cannot be opened until it returns
+/// Returns errFileInUse when one of them is open
+/// Only the opens of the paths wait, the mutex is not held while commit runs
+func (fs *S3FS) whileClosed(paths []string, commit func() error) error {
+	fs.mutex.Lock()
+	if fs.hasOpenFHsLocked(paths) {
+		fs.mutex.Unlock()
+		return errFileInUse
+	}
+
+	fs.beginCommitLocked(paths)
+	fs.mutex.Unlock()
+	defer fs.endCommit(paths)
+
+	return commit()
+}
+
+/// The paths cannot be opened and no handle of them is registered until endCommit
+func (fs *S3FS) beginCommit(paths []string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.beginCommitLocked(paths)
+}
+
+// The mutex must be held
+func (fs *S3FS) beginCommitLocked(paths []string) {
+	for _, path := range paths {
+		fs.committing[path]++
+	}
+}
+
+func (fs *S3FS) endCommit(paths []string) {
+	fs.mutex.Lock()
+	for _, path := range paths {
+		if fs.committing[path]--; fs.committing[path] == 0 {
+			delete(fs.committing, path)
+		}
+	}
+	fs.mutex.Unlock()
+	fs.committed.Broadcast()
+}
+
+/// Lock the file handles opened with one of the paths, returns them to unlock them later
+/// They are locked once the mutex is released, a handle being released holds its own
+/// lock while unregistering itself
+func (fs *S3FS) lockFHs(paths []string) []*S3File {
+	fs.mutex.Lock()
+	fhs := make([]*S3File, 0)
+	for _, path := range paths {
+		fhs = append(fhs, fs.fhmap[path]...)
+	}
+	fs.mutex.Unlock()
+
+	for _, fh := range fhs {
 		fh.Mutex.Lock()
 	}
+	return fhs
 }
 
-func (fs *S3FS) unlockFHs(path string) {
-	for _, fh := range fs.fhmap[path] {
+func (fs *S3FS) unlockFHs(fhs []*S3File) {
+	for _, fh := range fhs {
 		fh.Mutex.Unlock()
 	}
 }
 
-func (fs *S3FS) reloadFds(path string) error {
-	for _, fh := range fs.fhmap[path] {
-		fd, err := syscall.Open(fh.Path, int(fh.Flags), 0)
-		if err != nil {
+/// Reopen the file handles on the file now at their path
+/// The handles must be locked by the caller
+func (fs *S3FS) reloadFds(fhs []*S3File) error {
+	for _, fh := range fhs {
+		if err := reopenFH(fh); err != nil {
 			return err
 		}
-
-		if fh.Fd != -1 {
-			syscall.Close(fh.Fd)
-		}
-
-		fh.Fd = fd
 	}
 
 	return nil
 }
 
-func (fs *S3FS) catchSignals() {
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGQUIT)
-	go func() {
-		sig := <-sigs
+// The handle must be locked or not registered yet
+func reopenFH(fh *S3File) error {
+	// The file was created or truncated by the first open already
+	fd, err := syscall.Open(fh.Path, int(fh.Flags)&^(syscall.O_CREAT|syscall.O_EXCL|syscall.O_TRUNC), 0)
+	if err != nil {
+		return err
+	}
 
-		if len(fs.orm.batch) > 0 {
-			fs.logger.Printf("Registering %v unsaved entries\n", len(fs.orm.batch))
-			fs.orm.db.Create(&fs.orm.batch)
-		}
+	if fh.Fd != -1 {
+		syscall.Close(fh.Fd)
+	}
 
-		fs.logger.Printf("Unmounting: %v (Signal: %v)\n", fs.mountPath, sig)
-		if err := fs.Stop(); err != nil {
-			fs.logger.Printf("Error while unmounting: %v\n", fs.mountPath)
-		}
-	}()
+	fh.Fd = fd
+	return nil
 }
@@ -11,6 +11,7 @@ require github.com/rhysd/go-github-selfupdate v1.2.2
 
 require (
 	github.com/blang/semver v3.5.1+incompatible
+	github.com/estebangarcia21/subprocess v0.0.0-20211231005935-fb739ac445af
 	github.com/google/uuid v1.3.0
 	github.com/robfig/cron v1.2.0
 	golang.org/x/exp v0.0.0-20220613132600-b0d781184e0d
@@ -21,7 +22,6 @@ require (
 )
 
 require (
-	github.com/estebangarcia21/subprocess v0.0.0-20211231005935-fb739ac445af // indirect
 	github.com/golang/protobuf v1.3.2 // indirect
 	github.com/google/go-github/v30 v30.1.0 // indirect
 	github.com/google/go-querystring v1.0.0 // indirect
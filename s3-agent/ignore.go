@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the gitignore-style files listing the paths that must stay local
+const ignoreFileName = ".s3ignore"
+
+// A gitignore-style pattern
+type ignorePattern struct {
+	// glob segments separated by "/", "**" matches any number of segments
+	glob string
+
+	// the pattern starts with "!" and re-includes the matching paths
+	negate bool
+
+	// the pattern ends with "/" and only matches directories
+	dirOnly bool
+
+	// the pattern contains a "/" and is relative to its base directory,
+	// otherwise it matches a name at any depth
+	anchored bool
+}
+
+// Parse a gitignore-style line, returns nil for blank lines and comments
+func parseIgnorePattern(line string) (*ignorePattern, error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	pattern := &ignorePattern{}
+
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		// "\#" and "\!" escape the first character
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if strings.Contains(line, "/") {
+		pattern.anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+
+	if line == "" {
+		return nil, nil
+	}
+
+	// Check the glob syntax once and for all
+	for _, segment := range strings.Split(line, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	pattern.glob = line
+	return pattern, nil
+}
+
+func parseIgnorePatterns(lines []string) ([]*ignorePattern, error) {
+	patterns := make([]*ignorePattern, 0, len(lines))
+
+	for _, line := range lines {
+		pattern, err := parseIgnorePattern(line)
+		if err != nil {
+			return nil, err
+		}
+
+		if pattern != nil {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	return patterns, nil
+}
+
+// Does the pattern match the slash separated path, relative to the pattern base directory
+func (p *ignorePattern) match(relativePath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+
+	if p.anchored {
+		return matchGlob(strings.Split(p.glob, "/"), strings.Split(relativePath, "/"))
+	}
+
+	ok, _ := path.Match(p.glob, path.Base(relativePath))
+	return ok
+}
+
+func matchGlob(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchGlob(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+
+		pattern, segments = pattern[1:], segments[1:]
+	}
+
+	return len(segments) == 0
+}
+
+// As in gitignore, the last matching pattern wins
+func matchPatterns(patterns []*ignorePattern, relativePath string, isDir bool, matched bool) bool {
+	for _, pattern := range patterns {
+		if pattern.match(relativePath, isDir) {
+			matched = !pattern.negate
+		}
+	}
+
+	return matched
+}
+
+// Decides which files of a rule tree must stay local from the rule include and
+// exclude patterns and from the .s3ignore files found in the tree
+// The .s3ignore files are read once per filter, create a new one to see their changes
+type PathFilter struct {
+	root    string
+	include []*ignorePattern
+	exclude []*ignorePattern
+
+	// parsed .s3ignore files by directory relative to root
+	ignoreFiles map[string][]*ignorePattern
+}
+
+// The patterns of the rule must have been validated by Config.IsValid
+func NewPathFilter(root string, rule *Rule) *PathFilter {
+	include, _ := parseIgnorePatterns(rule.IncludePatterns)
+	exclude, _ := parseIgnorePatterns(rule.ExcludePatterns)
+
+	return &PathFilter{
+		root:        root,
+		include:     include,
+		exclude:     exclude,
+		ignoreFiles: make(map[string][]*ignorePattern),
+	}
+}
+
+// Returns true if the file must never be sent to remote
+func (f *PathFilter) IsExcluded(filePath string) bool {
+	relativePath := ""
+	if !IsSubpath(f.root, filePath, &relativePath) {
+		return false
+	}
+
+	relativePath = filepath.ToSlash(relativePath)
+
+	// Sending them would hide the patterns from the next cycles
+	// Loading it right away keeps its patterns when the importer moves it afterwards
+	if path.Base(relativePath) == ignoreFileName {
+		if dir := path.Dir(relativePath); dir != "." {
+			f.loadIgnoreFile(dir)
+		} else {
+			f.loadIgnoreFile("")
+		}
+		return true
+	}
+
+	segments := strings.Split(relativePath, "/")
+	included := len(f.include) == 0
+
+	// A file is excluded when itself or one of its parent directories is excluded
+	for i := 1; i <= len(segments); i++ {
+		prefix := strings.Join(segments[:i], "/")
+		isDir := i < len(segments)
+
+		if matchPatterns(f.exclude, prefix, isDir, false) || f.isIgnored(segments[:i], isDir) {
+			return true
+		}
+
+		included = matchPatterns(f.include, prefix, isDir, included)
+	}
+
+	return !included
+}
+
+// Apply the .s3ignore files from the root to the parent directory of the path
+// Deeper files override the patterns of their parents
+func (f *PathFilter) isIgnored(segments []string, isDir bool) bool {
+	ignored := false
+
+	for i := 0; i < len(segments); i++ {
+		base := strings.Join(segments[:i], "/")
+		ignored = matchPatterns(f.loadIgnoreFile(base), strings.Join(segments[i:], "/"), isDir, ignored)
+	}
+
+	return ignored
+}
+
+func (f *PathFilter) loadIgnoreFile(base string) []*ignorePattern {
+	if patterns, ok := f.ignoreFiles[base]; ok {
+		return patterns
+	}
+
+	lines := make([]string, 0)
+	if file, err := os.Open(filepath.Join(f.root, filepath.FromSlash(base), ignoreFileName)); err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		file.Close()
+	}
+
+	// Invalid lines are skipped, like git does
+	patterns := make([]*ignorePattern, 0, len(lines))
+	for _, line := range lines {
+		if pattern, err := parseIgnorePattern(line); err == nil && pattern != nil {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	f.ignoreFiles[base] = patterns
+	return patterns
+}
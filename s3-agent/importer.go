@@ -50,6 +50,7 @@ func importFS(rule Rule, config *ConfigPath, orm *SQlite) error {
 
 	loopbackRoot := config.GetLoopbackFSPath(orm.GetRule(rule.Src).UUID)
 	rclone := NewRClone(config)
+	filter := NewPathFilter(rule.Src, &rule)
 
 	log.Println("Import process: Creating folders ...")
 
@@ -60,12 +61,15 @@ func importFS(rule Rule, config *ConfigPath, orm *SQlite) error {
 
 	log.Println("Import process: Copying files ...")
 
+	// Entries of the files linked more than once, by inode
+	inodes := make(map[uint64]*S3NodeTable)
+
 	if err := customWalkFile(rule.Src,
 		func(oldPath string, info os.FileInfo) error {
 			newPath := filepath.Join(loopbackRoot, oldPath[len(rule.Src)-1:])
 
 			if info.Mode().IsRegular() {
-				return importFile(oldPath, newPath, info, rule, orm, rclone)
+				return importFile(oldPath, newPath, info, rule, orm, rclone, filter, inodes)
 			}
 
 			// We need to recreate the symlink correctly
@@ -172,12 +176,28 @@ func customWalkFile(dirPath string, walkFunc customWalkFunc) error {
 }
 
 // Add the file to the DB and send it to remote if we need
-func importFile(oldPath, newPath string, info os.FileInfo, rule Rule, orm *SQlite, rclone *RClone) error {
+func importFile(oldPath, newPath string, info os.FileInfo, rule Rule, orm *SQlite, rclone *RClone, filter *PathFilter, inodes map[uint64]*S3NodeTable) error {
+
+	// The other names of a file linked more than once share its entry and its loopback file,
+	// the inode is looked up whatever its link count: the names already imported are removed
+	stat, _ := info.Sys().(*syscall.Stat_t)
+	if stat != nil && inodes[stat.Ino] != nil {
+		linked := inodes[stat.Ino]
+		if err := os.Link(linked.Path, newPath); err != nil {
+			return err
+		}
+		if err := os.Remove(oldPath); err != nil {
+			return err
+		}
+
+		log.Printf("Imported link: %v -> %v", oldPath, linked.Path)
+		return orm.AddLink(linked, newPath)
+	}
 
 	var entries []S3NodeTable
 	var entry *S3NodeTable
 
-	orm.db.Model(&entry).Where("Path = ?", oldPath).Find(&entries)
+	orm.db.Model(&entry).Where("Path = ?", oldPath).Preload("S3RuleTable").Find(&entries)
 
 	dest := "local"
 
@@ -189,15 +209,55 @@ func importFile(oldPath, newPath string, info os.FileInfo, rule Rule, orm *SQlit
 		orm.db.Model(&entry).Where("Path = ?", oldPath).Preload("S3RuleTable").Update("Path", entry.Path)
 	}
 
-	if rule.MustBeRemote(oldPath) {
+	if stat != nil && stat.Nlink > 1 && entry != nil {
+		inodes[stat.Ino] = entry
+	}
+
+	mustBeRemote := !filter.IsExcluded(oldPath) && rule.MustBeRemote(oldPath, entry)
+
+	// The file is sent from the loopback, so that an interrupted import is replayed like any upload
+	if err := moveFile(oldPath, newPath); err != nil {
+		return err
+	}
+
+	// The small files are packed together by the first cycle of the agent (See pack.go)
+	if entry.Local && mustBeRemote && rule.IsPackable(info.Size()) {
+		log.Printf("Imported file: %v -> local, packed by the first cycle", oldPath)
+		return nil
+	}
 
-		if err := rclone.Send(rule.Dest, oldPath, entry); err != nil {
+	if entry.Local && mustBeRemote {
+
+		checksum, err := fileMD5(newPath)
+		if err != nil {
 			return err
 		}
 
-		orm.SendToServer(entry, rule.Dest, info.Size())
+		intent := newUploadIntent(entry, newPath, rule.Dest, info.Size(), checksum)
+		if err := orm.BeginIntent(intent); err != nil {
+			return err
+		}
+		defer orm.EndIntent(intent)
 
-		if err := syscall.Truncate(oldPath, 0); err != nil {
+		objectKey, err := rclone.Send(rule.Dest, newPath, entry)
+		if err != nil {
+			return err
+		}
+
+		// The local data is only dropped once the server holds the same bytes
+		if err := rclone.VerifyObject(rule.Dest, objectKey, info.Size(), checksum); err != nil {
+			rclone.RemoveObject(rule.Dest, objectKey)
+			return err
+		}
+
+		orm.SendToServer(entry, rule.Dest, objectKey, info.Size(), checksum)
+
+		// Lets the rebuild command find the object of the file
+		if err := setUUIDXattr(newPath, entry.UUID); err != nil {
+			log.Println("Error keeping the UUID of the file", err)
+		}
+
+		if err := syscall.Truncate(newPath, 0); err != nil {
 			log.Println("Error truncating the file locally", err)
 			return err
 		}
@@ -206,5 +266,5 @@ func importFile(oldPath, newPath string, info os.FileInfo, rule Rule, orm *SQlit
 	}
 
 	log.Printf("Imported file: %v -> %v", oldPath, dest)
-	return moveFile(oldPath, newPath)
+	return nil
 }
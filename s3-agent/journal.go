@@ -0,0 +1,259 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Transitions recorded in the journal before they start, a crash in the middle of one
+// leaves its intent in the DB and the next run replays or rolls it back (See ReplayIntents)
+type intentKind string
+
+const (
+	// Send, verify, mark the entry remote then truncate the file
+	UPLOAD_INTENT intentKind = "upload"
+
+	// Mark the entry of a clean cached file remote then truncate the file, nothing is sent
+	EVICT_INTENT intentKind = "evict"
+
+	// Download to staging, verify, move in place, mark the entry local then remove the object
+	DOWNLOAD_INTENT intentKind = "download"
+
+	// The filesystem of a rule is mounted, its new entries are batched until the next flush
+	MOUNT_INTENT intentKind = "mount"
+)
+
+func newUploadIntent(entry *S3NodeTable, path, server string, size int64, checksum string) *S3IntentTable {
+	return &S3IntentTable{
+		Kind:      UPLOAD_INTENT,
+		UUID:      entry.UUID,
+		Path:      path,
+		Server:    server,
+		ObjectKey: newObjectKey(entry),
+		Size:      size,
+		Checksum:  checksum,
+	}
+}
+
+func newPackIntent(entry *S3NodeTable, pack *S3PackTable, size int64, checksum string) *S3IntentTable {
+	return &S3IntentTable{
+		Kind:      UPLOAD_INTENT,
+		UUID:      entry.UUID,
+		Path:      entry.Path,
+		Server:    pack.Server,
+		ObjectKey: pack.ObjectKey,
+		Size:      size,
+		Checksum:  checksum,
+		PackID:    pack.ID,
+	}
+}
+
+func newEvictIntent(entry *S3NodeTable) *S3IntentTable {
+	return &S3IntentTable{
+		Kind:      EVICT_INTENT,
+		UUID:      entry.UUID,
+		Path:      entry.Path,
+		Server:    entry.Server,
+		ObjectKey: entry.ObjectKey,
+		Size:      entry.Size,
+		Checksum:  entry.Checksum,
+		PackID:    entry.PackID,
+	}
+}
+
+func newDownloadIntent(entry *S3NodeTable, objectKey string, keepRemote bool) *S3IntentTable {
+	return &S3IntentTable{
+		Kind:       DOWNLOAD_INTENT,
+		UUID:       entry.UUID,
+		Path:       entry.Path,
+		Server:     entry.Server,
+		ObjectKey:  objectKey,
+		Size:       entry.Size,
+		Checksum:   entry.Checksum,
+		KeepRemote: keepRemote,
+		PackID:     entry.PackID,
+	}
+}
+
+func newMountIntent(rule *S3RuleTable) *S3IntentTable {
+	return &S3IntentTable{
+		Kind: MOUNT_INTENT,
+		UUID: rule.UUID,
+		Path: rule.Path,
+	}
+}
+
+// Bring the DB and the disk back in agreement after a crash, must run before the filesystems are mounted
+// The intents which cannot be replayed yet, the server being unreachable for example, are kept for the next run
+func ReplayIntents(config *ConfigPath, orm *SQlite, rclone *RClone) {
+	for _, intent := range orm.GetIntents() {
+		log.Printf("Replaying the %v intent of: %v", intent.Kind, intent.Path)
+
+		var err error
+		switch intent.Kind {
+		case UPLOAD_INTENT, EVICT_INTENT:
+			err = replayUpload(orm, rclone, &intent)
+		case DOWNLOAD_INTENT:
+			err = replayDownload(config, orm, rclone, &intent)
+		case MOUNT_INTENT:
+			err = replayMount(config, orm, &intent)
+		}
+
+		if err != nil {
+			log.Printf("Cannot replay the %v intent of %v: %v", intent.Kind, intent.Path, err)
+			continue
+		}
+
+		orm.EndIntent(&intent)
+	}
+}
+
+// The file is kept if it was truncated, or if it still has the sent content, the upload is rolled back otherwise
+// The evictions are replayed the same way, the object was sent by an earlier upload
+func replayUpload(orm *SQlite, rclone *RClone, intent *S3IntentTable) error {
+	entry := orm.GetEntryByUUID(intent.UUID)
+
+	// The file was removed, its object with it unless it was not tracked yet
+	if entry == nil {
+		return removeIntentObject(rclone, intent)
+	}
+
+	// The entry was not updated, the kept copy of an evicted file is still valid
+	if entry.Local && intent.Kind == EVICT_INTENT {
+		return nil
+	}
+
+	// The entry was not updated, the object may be partial or complete
+	if entry.Local {
+		if err := removeIntentObject(rclone, intent); err != nil {
+			return err
+		}
+
+		// The object was the one kept by the last recall, it is gone now
+		if entry.Server == intent.Server && entry.ObjectKey == intent.ObjectKey {
+			orm.RetriveFromServer(entry, false)
+		}
+		return nil
+	}
+
+	info, err := os.Stat(entry.Path)
+	if err != nil {
+		return err
+	}
+
+	// Truncated already
+	if info.Size() == 0 || hasCachedBlocks(entry.Path) {
+		return setUUIDXattr(entry.Path, entry.UUID)
+	}
+
+	if hasContent(entry.Path, info.Size(), intent) {
+		log.Println("Finishing the upload of: ", entry.Path)
+		if err := setUUIDXattr(entry.Path, entry.UUID); err != nil {
+			return err
+		}
+		if entry.PackID != "" {
+			if err := setPackXattr(entry.Path, entry); err != nil {
+				return err
+			}
+		}
+		return syscall.Truncate(entry.Path, 0)
+	}
+
+	// The file changed after the upload, the local content wins
+	log.Println("Rolling back the upload of: ", entry.Path)
+	if err := removeIntentObject(rclone, intent); err != nil {
+		return err
+	}
+	orm.RetriveFromServer(entry, false)
+	orm.SetSize(entry, info.Size())
+	return nil
+}
+
+// The recall is finished if the file was moved in place, the partial downloads are removed on startup
+func replayDownload(config *ConfigPath, orm *SQlite, rclone *RClone, intent *S3IntentTable) error {
+	entry := orm.GetEntryByUUID(intent.UUID)
+
+	// The file was removed, the object may have missed the removal
+	if entry == nil {
+		return removeIntentObject(rclone, intent)
+	}
+
+	if !entry.Local {
+		info, err := os.Stat(entry.Path)
+		if err != nil {
+			return err
+		}
+
+		// Still the truncated or sparse file
+		if !hasContent(entry.Path, info.Size(), intent) {
+			return nil
+		}
+
+		// The crash may have left some names on the truncated file
+		log.Println("Finishing the recall of: ", entry.Path)
+		if err := linkNames(filepath.Join(config.GetStagingPath(), entry.UUID), orm.GetNames(entry)); err != nil {
+			return err
+		}
+		orm.RetriveFromServer(entry, intent.KeepRemote)
+	}
+
+	if intent.KeepRemote {
+		return nil
+	}
+	return removeIntentObject(rclone, intent)
+}
+
+// Remove the object of the intent, the packs are shared with other files and left to the repack command
+func removeIntentObject(rclone *RClone, intent *S3IntentTable) error {
+	if intent.PackID != "" {
+		return nil
+	}
+	return rclone.RemoveObject(intent.Server, intent.ObjectKey)
+}
+
+// Does the loopback file hold the content of the intent, the files without checksum are only checked by size
+func hasContent(path string, size int64, intent *S3IntentTable) bool {
+	if size != intent.Size || hasCachedBlocks(path) {
+		return false
+	}
+
+	if intent.Checksum == "" {
+		return size > 0
+	}
+
+	checksum, err := fileMD5(path)
+	return err == nil && checksum == intent.Checksum
+}
+
+// The batched entries of the new files were lost, the loopback files missing from the DB are registered again
+func replayMount(config *ConfigPath, orm *SQlite, intent *S3IntentTable) error {
+	loopback := config.GetLoopbackFSPath(intent.UUID)
+
+	// Entries of the untracked files linked more than once, by inode
+	inodes := make(map[uint64]*S3NodeTable)
+
+	return filepath.Walk(loopback, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() || orm.GetEntry(intent.Path, path, 0) != nil {
+			return nil
+		}
+
+		stat, _ := info.Sys().(*syscall.Stat_t)
+		linked := stat != nil && stat.Nlink > 1
+		if linked && inodes[stat.Ino] != nil {
+			return orm.AddLink(inodes[stat.Ino], path)
+		}
+
+		log.Println("Registering the untracked file: ", path)
+		entry := orm.CreateEntry(intent.Path, path, info.Size())
+		if linked && entry != nil {
+			inodes[stat.Ino] = entry
+		}
+		return nil
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 
@@ -15,6 +16,7 @@ import (
 	"github.com/blang/semver"
 	"github.com/rhysd/go-github-selfupdate/selfupdate"
 	"github.com/robfig/cron"
+	"golang.org/x/exp/slices"
 )
 
 const version = "0.1.3"
@@ -37,42 +39,122 @@ func (cmd *SyncCmd) Run(ctx *Context) error {
 		return err
 	}
 
-	rule := config.Rules[0]
 	orm := NewSQlite(ctx.ConfigPath)
-	dbEntry := orm.AddIfNotExistsRule(rule.Src)
-	loopback := ctx.ConfigPath.GetLoopbackFSPath(dbEntry.UUID)
+	cron := cron.New()
 
-	if _, err := os.Stat(rule.Src); err == nil {
+	// The recalls interrupted by a crash leave partial downloads behind, their files are still remote
+	if err := os.RemoveAll(ctx.ConfigPath.GetStagingPath()); err != nil {
+		log.Println("Cannot clean the recalled files", err)
+	}
 
-		if err := importFS(rule, ctx.ConfigPath, orm); err != nil {
-			log.Println("Error while importing existing files: ", err)
-			return err
+	// The transitions interrupted by a crash are finished or rolled back before anything else runs
+	ReplayIntents(ctx.ConfigPath, orm, NewRClone(ctx.ConfigPath))
+
+	// Ended once the batched entries are flushed on shutdown
+	mounts := make([]*S3IntentTable, 0, len(config.Rules))
+	filesystems := make([]*S3FS, 0, len(config.Rules))
+
+	// The rules set up before one fails are released, their mounts are not replayed
+	abort := func(err error) error {
+		for _, fs := range filesystems {
+			fs.sender.Stop()
+		}
+
+		orm.FlushBatch()
+		for _, mount := range mounts {
+			orm.EndIntent(mount)
+		}
+		return err
+	}
+
+	// One filesystem, one sender and one cron entry per rule
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		dbEntry := orm.AddIfNotExistsRule(rule.Src)
+		loopback := ctx.ConfigPath.GetLoopbackFSPath(dbEntry.UUID)
+
+		mount := newMountIntent(dbEntry)
+		if err := orm.BeginIntent(mount); err != nil {
+			log.Println("Cannot record the mount of the rule", err)
+			return abort(err)
 		}
+		mounts = append(mounts, mount)
 
 		if _, err := os.Stat(rule.Src); err == nil {
-			log.Println("Cannot mount destination: file exists: ", rule.Src)
+
+			if err := importFS(*rule, ctx.ConfigPath, orm); err != nil {
+				log.Println("Error while importing existing files: ", err)
+				return abort(err)
+			}
+
+			if _, err := os.Stat(rule.Src); err == nil {
+				log.Println("Cannot mount destination: file exists: ", rule.Src)
+			}
+		}
+
+		fs := NewS3FS(loopback, rule.Src, rule, ctx.ConfigPath, orm)
+		sender, err := NewS3Sender(rule, fs, config.ExcludePatterns, ctx.ConfigPath, orm)
+		if err != nil {
+			log.Println("Failed to create Cron sender", err)
+			return abort(err)
+		}
+
+		fs.sender = sender
+
+		if err := cron.AddFunc(rule.GetCronSender(), sender.Cycle); err != nil {
+			log.Printf("Invalid cron '%v' for rule '%v': %v", rule.GetCronSender(), rule.Src, err)
+			sender.Stop()
+			return abort(err)
 		}
+
+		filesystems = append(filesystems, fs)
 	}
 
-	fs := NewS3FS(loopback, rule.Src, ctx.ConfigPath, orm)
-	sender, err := NewS3Sender(&rule, fs, config.ExcludePatterns, ctx.ConfigPath, orm)
-	if err != nil {
-		log.Println("Failed to create Cron sender", err)
-		return err
+	for i, fs := range filesystems {
+		if err := fs.Run(ctx.ConfigPath.debug); err != nil {
+			log.Printf("Cannot mount filesystem at pas %v", err)
+			for _, mounted := range filesystems[:i] {
+				mounted.Stop()
+			}
+			return abort(err)
+		}
 	}
 
-	cron := cron.New()
-	cron.AddFunc(rule.CronSender, sender.Cycle)
+	for _, fs := range filesystems {
+		fs.sender.Start()
+	}
 	cron.Start()
 
-	if err := fs.Run(ctx.ConfigPath.debug); err != nil {
-		log.Printf("Cannot mount filesystem at pas %v", err)
-		return err
+	// The small files left local by the import or by the last run are packed right away
+	for _, fs := range filesystems {
+		if fs.rule.Pack != nil {
+			go fs.sender.Cycle()
+		}
 	}
 
-	fs.WaitStop()
+	// Run until a termination signal is received.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	sig := <-sigs
+	log.Printf("Received %v Signal. Shutdown ...\n", sig)
 
 	cron.Stop()
+
+	for _, fs := range filesystems {
+		fs.sender.Stop()
+
+		if err := fs.Stop(); err != nil {
+			log.Printf("Error while unmounting: %v\n", fs.mountPath)
+		}
+	}
+
+	// No entry can be batched anymore
+	orm.FlushBatch()
+	for _, mount := range mounts {
+		orm.EndIntent(mount)
+	}
+
 	return nil
 }
 
@@ -90,32 +172,39 @@ func (cmd *DryRunCmd) Run(ctx *Context) error {
 		return err
 	}
 
-	rule := config.Rules[0]
-	uuid := uuid.New().String()
+	cron := cron.New()
+
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		uuid := uuid.New().String()
+
+		if _, err := os.Stat(rule.Src); errors.Is(err, os.ErrNotExist) {
+			err := os.Mkdir(rule.Src, os.ModePerm)
+			if err != nil {
+				log.Println("Error while trying to create rule Src folder: ", err)
+				return err
+			}
+		}
 
-	if _, err := os.Stat(rule.Src); errors.Is(err, os.ErrNotExist) {
-		err := os.Mkdir(rule.Src, os.ModePerm)
+		sender, err := NewS3Sender(rule, nil, config.ExcludePatterns, ctx.ConfigPath, nil)
 		if err != nil {
-			log.Println("Error while trying to create rule Src folder: ", err)
+			log.Println("Failed to create Cron sender", err)
 			return err
 		}
-	}
 
-	sender, err := NewS3Sender(&rule, nil, config.ExcludePatterns, ctx.ConfigPath, nil)
-	if err != nil {
-		log.Println("Failed to create Cron sender", err)
-		return err
+		if err := cron.AddFunc(rule.GetCronSender(), func() { sender.DryRunCycle(uuid) }); err != nil {
+			log.Printf("Invalid cron '%v' for rule '%v': %v", rule.GetCronSender(), rule.Src, err)
+			return err
+		}
 	}
 
-	cron := cron.New()
-	cron.AddFunc(rule.CronSender, func() { sender.DryRunCycle(uuid) })
 	cron.Start()
 
 	// Run until a termination signal is received.
 	sigs := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
 
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGQUIT)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
 	go func() {
 		sig := <-sigs
@@ -160,17 +249,48 @@ func (cmd *RebuildDbCmd) Run(ctx *Context) error {
 
 	ruleFolder := ctx.ConfigPath.GetLoopbackFSPath(cmd.UUID)
 
+	// Entries of the files linked more than once, by inode
+	inodes := make(map[uint64]*S3NodeTable)
+
 	filepath.Walk(ruleFolder, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
+		// The pins are kept as extended attributes on the loopback
+		if pinned, err := getXattrBool(path, pinnedXattr); err == nil && pinned {
+			log.Println("Restoring pin: ", path)
+			orm.Pin(path)
+		}
+
 		if !info.IsDir() {
+			// The other names of a file linked more than once share its entry
+			stat, _ := info.Sys().(*syscall.Stat_t)
+			linked := stat != nil && stat.Nlink > 1
+			if linked && inodes[stat.Ino] != nil {
+				log.Println("Restoring link: ", path)
+				orm.AddLink(inodes[stat.Ino], path)
+				return nil
+			}
+
 			log.Println("Handling file: ", path)
-			entry := orm.CreateEntry(cmd.UUID, path, info.Size())
-			if entry.Size == 0 {
-				if size, err := rclone.GetSize(entry, rule.Dest); err == nil && size > 0 {
-					orm.SendToServer(entry, rule.Dest, size)
+			entry := orm.CreateEntry(rule.Src, path, info.Size())
+			if linked {
+				inodes[stat.Ino] = entry
+			}
+
+			// The UUID of the files sent to remote is kept on the loopback, their object key is built from it
+			if entryUUID, err := getXattrString(path, uuidXattr); err == nil && entryUUID != "" && entryUUID != entry.UUID {
+				orm.SetEntryUUID(entry, entryUUID)
+				entry.UUID = entryUUID
+			}
+
+			// Remote files are empty, or sparse when some of their blocks were streamed
+			if entry.Size == 0 || hasCachedBlocks(path) {
+				if objectKey, size, checksum, err := rclone.FindObject(entry, rule.Dest); err == nil {
+					orm.SendToServer(entry, rule.Dest, objectKey, size, checksum)
+				} else if packID, offset, length, err := getPackXattr(path); err == nil && packID != "" {
+					restorePackEntry(orm, rclone, entry, &rule, cmd.UUID, packID, offset, length)
 				}
 			}
 		}
@@ -183,8 +303,244 @@ func (cmd *RebuildDbCmd) Run(ctx *Context) error {
 	return nil
 }
 
+// The file was sent in a pack, the range of the pack is kept on the loopback file
+// Its checksum is lost, the recall only checks the size of the file
+func restorePackEntry(orm *SQlite, rclone *RClone, entry *S3NodeTable, rule *Rule, ruleUUID, packID string, offset, length int64) {
+	pack := &S3PackTable{
+		ID:              packID,
+		S3RuleTablePath: rule.Src,
+		Server:          rule.Dest,
+		ObjectKey:       newPackKey(ruleUUID, packID),
+	}
+
+	size, err := rclone.ObjectSize(pack.Server, pack.ObjectKey)
+	if err != nil {
+		log.Println("Cannot find the pack of: ", entry.Path, err)
+		return
+	}
+
+	pack.Size = size
+	orm.AddIfNotExistsPack(pack)
+	orm.SendToPack(entry, pack, offset, length, "")
+}
+
+type FsckCmd struct{}
+
+// Bring the pins of the DB back in agreement with the ones kept on the loopback files
+// The attribute is written before the DB (See S3Node.setPin), the loopback wins:
+// the pins found on the loopback are restored, the pins of the DB missing there are dropped
+func (cmd *FsckCmd) Run(ctx *Context) error {
+	config, err := LoadConfig(ctx.ConfigPath.GetAgentConfigPath())
+	if err != nil {
+		log.Println("Cannot load config", err)
+		return err
+	}
+
+	orm := NewSQlite(ctx.ConfigPath)
+	pins := orm.GetPins()
+
+	for _, rule := range config.Rules {
+		// The rule was never synced, the empty UUID would walk the loopback of every rule
+		ruleTable := orm.GetRule(rule.Src)
+		if ruleTable.UUID == "" {
+			continue
+		}
+
+		ruleFolder := ctx.ConfigPath.GetLoopbackFSPath(ruleTable.UUID)
+		err := filepath.Walk(ruleFolder, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if pinned, err := getXattrBool(path, pinnedXattr); err == nil && pinned && !slices.Contains(pins, path) {
+				log.Println("Restoring pin: ", path)
+				return orm.Pin(path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, pin := range pins {
+			if !IsSubpath(ruleFolder, pin, nil) {
+				continue
+			}
+
+			if pinned, err := getXattrBool(pin, pinnedXattr); err != nil || !pinned {
+				log.Println("Dropping pin: ", pin)
+				if err := orm.Unpin(pin); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+type RepackCmd struct {
+	DryRun bool `help:"Only list the packs to rewrite or remove."`
+}
+
+// Reclaim the space of the packs: the packs left without files are removed, the ones
+// holding more garbage than the ratio of their rule are rewritten with their files only
+// The agent must be stopped: its recalls and uploads would race with the moves of the
+// ranges. A running agent, or one which crashed, is detected by its intents left in the DB.
+func (cmd *RepackCmd) Run(ctx *Context) error {
+	config, err := LoadConfig(ctx.ConfigPath.GetAgentConfigPath())
+	if err != nil {
+		log.Println("Cannot load config", err)
+		return err
+	}
+
+	if err = ctx.ConfigPath.WriteRCloneConfig(config.RCloneConfig); err != nil {
+		log.Println("Cannot write rclone config", err)
+		return err
+	}
+
+	rclone := NewRClone(ctx.ConfigPath)
+	orm := NewSQlite(ctx.ConfigPath)
+
+	// The mounts are recorded until the agent stops, a crashed agent is started once to replay them
+	if intents := orm.GetIntents(); len(intents) > 0 && !cmd.DryRun {
+		return fmt.Errorf("The agent is running or did not stop cleanly (%v pending intents): stop it before repacking", len(intents))
+	}
+
+	failed := 0
+	reclaimed := int64(0)
+
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		packs := orm.GetPacks(rule.Src)
+
+		for j := range packs {
+			pack := &packs[j]
+
+			if cmd.DryRun {
+				live := int64(0)
+				members := orm.GetPackMembers(pack)
+				for _, member := range members {
+					live += member.PackLength
+				}
+				fmt.Printf("%v: %v files, %v bytes, %v garbage bytes\n", pack.ObjectKey, len(members), pack.Size, pack.Size-live)
+				continue
+			}
+
+			size, err := repackPack(ctx.ConfigPath, orm, rclone, pack, rule.GetPackGarbageRatio())
+			if err != nil {
+				log.Println("Cannot repack: ", pack.ObjectKey, err)
+				failed++
+				continue
+			}
+			reclaimed += size
+		}
+	}
+
+	log.Printf("Reclaimed %v bytes\n", reclaimed)
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to repack %v packs", failed)
+	}
+	return nil
+}
+
+type MigrateKeysCmd struct{}
+
+// Move the objects uploaded under a key built from their path to the key built from
+// the UUID of their entry, so that renaming the files does not lose their content
+func (cmd *MigrateKeysCmd) Run(ctx *Context) error {
+	config, err := LoadConfig(ctx.ConfigPath.GetAgentConfigPath())
+	if err != nil {
+		log.Println("Cannot load config", err)
+		return err
+	}
+
+	if err = ctx.ConfigPath.WriteRCloneConfig(config.RCloneConfig); err != nil {
+		log.Println("Cannot write rclone config", err)
+		return err
+	}
+
+	rclone := NewRClone(ctx.ConfigPath)
+	orm := NewSQlite(ctx.ConfigPath)
+
+	var entries []S3NodeTable
+	for _, rule := range config.Rules {
+		// The rule was never synced
+		ruleTable := orm.GetRule(rule.Src)
+		if ruleTable.UUID == "" {
+			continue
+		}
+
+		entries = append(entries, orm.GetLegacyEntries(ctx.ConfigPath.GetLoopbackFSPath(ruleTable.UUID))...)
+	}
+
+	log.Printf("Migrating %v remote objects ...\n", len(entries))
+
+	failed := 0
+	for i := range entries {
+		entry := &entries[i]
+
+		objectKey, err := rclone.MigrateObject(entry)
+		if err != nil {
+			log.Println("Cannot migrate: ", entry.Path, err)
+			failed++
+			continue
+		}
+
+		orm.SetObjectKey(entry, objectKey)
+		if err := setUUIDXattr(entry.Path, entry.UUID); err != nil {
+			log.Println("Cannot keep the UUID of: ", entry.Path, err)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to migrate %v remote objects", failed)
+	}
+
+	log.Println("Finished migrating remote objects ...")
+	return nil
+}
+
+type StatusCmd struct {
+	Release bool `help:"Release the quarantined files, the sender tries them again."`
+}
+
+// List the files whose transfers keep failing, the quarantined ones are not tried anymore
+func (cmd *StatusCmd) Run(ctx *Context) error {
+	orm := NewSQlite(ctx.ConfigPath)
+
+	if cmd.Release {
+		fmt.Printf("Released %v quarantined transfers\n", orm.ReleaseQuarantine())
+		return nil
+	}
+
+	quarantined := 0
+	for _, failure := range orm.GetAllFailures() {
+		// The entry was removed while the failure was recorded
+		path := failure.Path
+		if entry := orm.GetEntryByUUID(failure.UUID); entry != nil {
+			path = entry.Path
+		}
+
+		if failure.Quarantined {
+			quarantined++
+			fmt.Printf("QUARANTINED %v %v: %v attempts, last error: %v\n", failure.Kind, path, failure.Attempts, failure.LastError)
+		} else if failure.NextRetry.IsZero() {
+			fmt.Printf("FAILING %v %v: %v attempts, tried again on the next access, last error: %v\n", failure.Kind, path,
+				failure.Attempts, failure.LastError)
+		} else {
+			fmt.Printf("RETRYING %v %v: %v attempts, next at %v, last error: %v\n", failure.Kind, path, failure.Attempts,
+				failure.NextRetry.Format(time.RFC3339), failure.LastError)
+		}
+	}
+
+	fmt.Printf("%v quarantined transfers\n", quarantined)
+	return nil
+}
+
 type TestRuleCmd struct {
-	Rule string `arg:"" help:"Name of the rule to test."`
+	Rule string `arg:"" help:"Type or source of the rule to test."`
 	Path string `arg:"" help:"Path of the file to test." type:"path"`
 }
 
@@ -196,7 +552,7 @@ func (cmd *TestRuleCmd) Run(ctx *Context) error {
 	}
 
 	for _, rule := range config.Rules {
-		if string(rule.Type) == cmd.Rule {
+		if string(rule.Type) == cmd.Rule || rule.Src == cmd.Rule {
 			// Get absolute path of the filesystem root handled by the rule
 			ruleSrc, err := filepath.Abs(rule.Src)
 			if err != nil {
@@ -208,12 +564,29 @@ func (cmd *TestRuleCmd) Run(ctx *Context) error {
 				log.Fatal("File is not part of the rule file system")
 			}
 
+			// The DB knows what the filesystem recorded about the file (last access, ...)
+			orm := NewSQlite(ctx.ConfigPath)
+			ruleEntry := orm.GetRule(rule.Src)
+
 			printResults := func(path string) {
-				if rule.MustBeRemote(path) {
+				var entry *S3NodeTable
+				relativePath := ""
+				if ruleEntry.UUID != "" && IsSubpath(ruleSrc, path, &relativePath) {
+					loopbackPath := filepath.Join(ctx.ConfigPath.GetLoopbackFSPath(ruleEntry.UUID), relativePath)
+					entry = orm.GetEntry(rule.Src, loopbackPath, 0)
+				}
+
+				mustBeRemote, explanation := rule.GetCondition().Explain(path, entry)
+				if mustBeRemote {
 					fmt.Printf("'%s' must be send to remote.\n", path)
 				} else {
 					fmt.Printf("'%s' must not be send to remote.\n", path)
 				}
+
+				// Detail which sub-conditions matched
+				for _, line := range explanation {
+					fmt.Printf("    %s\n", line)
+				}
 			}
 
 			if !IsDirectory(cmd.Path) {
@@ -267,13 +640,17 @@ func (cmd *ImportConfigCmd) Run(ctx *Context) error {
 }
 
 type CLI struct {
-	Debug        bool         `help:"Enable debug mode."`
-	ConfigFolder string       `help:"Path to the agent config folder."`
-	Sync         SyncCmd      `cmd:"" name:"sync" help:"Run the sync daemon."`
-	DryRun       DryRunCmd    `cmd:"" name:"dry-run" help:"Run the daemon in direct mode."`
-	Rebuild      RebuildDbCmd `cmd:"" name:"rebuild" help:"Rebuild the internal Postgres DB."`
-	TestRule     TestRuleCmd  `cmd:"" name:"test-rule" help:"Test a rule on a file."`
-	Config       ConfigCmd    `cmd:"" name:"config" help:"Manage the config."`
+	Debug        bool           `help:"Enable debug mode."`
+	ConfigFolder string         `help:"Path to the agent config folder."`
+	Sync         SyncCmd        `cmd:"" name:"sync" help:"Run the sync daemon."`
+	DryRun       DryRunCmd      `cmd:"" name:"dry-run" help:"Run the daemon in direct mode."`
+	Rebuild      RebuildDbCmd   `cmd:"" name:"rebuild" help:"Rebuild the internal Postgres DB."`
+	TestRule     TestRuleCmd    `cmd:"" name:"test-rule" help:"Test a rule on a file."`
+	MigrateKeys  MigrateKeysCmd `cmd:"" name:"migrate-keys" help:"Move the objects uploaded by older versions to keys that survive renames."`
+	Status       StatusCmd      `cmd:"" name:"status" help:"List the failing and quarantined transfers."`
+	Fsck         FsckCmd        `cmd:"" name:"fsck" help:"Repair the pins of the DB from the ones kept on the loopback files."`
+	Repack       RepackCmd      `cmd:"" name:"repack" help:"Reclaim the space left in the packs by the removed files, the agent must be stopped."`
+	Config       ConfigCmd      `cmd:"" name:"config" help:"Manage the config."`
 }
 
 func doSelfUpdate() {
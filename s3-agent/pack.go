@@ -0,0 +1,512 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Default pack settings, used for the fields left empty in the config
+const (
+	defaultPackMaxFileSize  = "1Mo"
+	defaultPackSize         = "64Mo"
+	defaultPackMaxFiles     = 1000
+	defaultPackGarbageRatio = 0.5
+)
+
+// Pack settings of a rule
+// The small files sent by a cycle are grouped in pack objects, each file is a range of its pack.
+// The ranges of the files removed or recalled are left in their pack until the repack command
+// rewrites the packs holding too much garbage (See RepackCmd).
+type PackConfig struct {
+	// files smaller than this size are packed, size parameter such as "1Mo"
+	MaxFileSize string `json:"max-file-size,omitempty"`
+
+	// maximum size and number of files of a pack, size parameter such as "64Mo"
+	Size     string `json:"size,omitempty"`
+	MaxFiles int    `json:"max-files,omitempty"`
+
+	// share of a pack, between 0 and 1, left by removed files before the repack command rewrites it
+	GarbageRatio float64 `json:"garbage-ratio,omitempty"`
+}
+
+func (config *PackConfig) IsValid() error {
+	if config.MaxFiles < 0 {
+		return fmt.Errorf("Pack max files must be positive")
+	}
+
+	if config.GarbageRatio < 0 || config.GarbageRatio > 1 {
+		return fmt.Errorf("Pack garbage ratio must be between 0 and 1: %v", config.GarbageRatio)
+	}
+
+	if _, err := parseSizeBytes(config.MaxFileSize); err != nil {
+		return fmt.Errorf("Invalid pack max file size: %v", err)
+	}
+
+	if _, err := parseSizeBytes(config.Size); err != nil {
+		return fmt.Errorf("Invalid pack size: %v", err)
+	}
+
+	return nil
+}
+
+// Is a file of this size sent in a pack
+func (rule *Rule) IsPackable(size int64) bool {
+	if rule.Pack == nil {
+		return false
+	}
+
+	maxFileSize := rule.Pack.MaxFileSize
+	if maxFileSize == "" {
+		maxFileSize = defaultPackMaxFileSize
+	}
+
+	// Validated by Config.IsValid
+	limit, _ := parseSizeBytes(maxFileSize)
+	return size < limit
+}
+
+// Maximum size in bytes and number of files of the packs of the rule
+func (rule *Rule) GetPackLimits() (int64, int) {
+	size, maxFiles := defaultPackSize, defaultPackMaxFiles
+	if rule.Pack != nil && rule.Pack.Size != "" {
+		size = rule.Pack.Size
+	}
+	if rule.Pack != nil && rule.Pack.MaxFiles != 0 {
+		maxFiles = rule.Pack.MaxFiles
+	}
+
+	// Validated by Config.IsValid
+	bytes, _ := parseSizeBytes(size)
+	return bytes, maxFiles
+}
+
+// Share of garbage of a pack above which the repack command rewrites it
+func (rule *Rule) GetPackGarbageRatio() float64 {
+	if rule.Pack == nil || rule.Pack.GarbageRatio == 0 {
+		return defaultPackGarbageRatio
+	}
+	return rule.Pack.GarbageRatio
+}
+
+// Key of a pack object, next to the objects of the files of the rule
+func newPackKey(ruleUUID, packID string) string {
+	return filepath.Join("s3-agent", ruleUUID, "packs", packID)
+}
+
+// A file written in the pack being built
+type packMember struct {
+	entry    *S3NodeTable
+	names    []string
+	offset   int64
+	length   int64
+	checksum string
+	modTime  time.Time
+}
+
+// Send the small files of a cycle in packs, the packs are sent by the workers of the rule
+func (s *S3Sender) sendPacks(entries []*S3NodeTable) {
+	maxSize, maxFiles := s.rule.GetPackLimits()
+
+	var packs sync.WaitGroup
+	for len(entries) > 0 {
+
+		// The first file is packed even if it is larger than the pack size
+		count, size := 0, int64(0)
+		for count < len(entries) && count < maxFiles {
+			info, err := os.Stat(entries[count].Path)
+			if err == nil && count > 0 && size+info.Size() > maxSize {
+				break
+			}
+			if err == nil {
+				size += info.Size()
+			}
+			count++
+		}
+
+		group := entries[:count]
+		entries = entries[count:]
+
+		s.slots <- true
+		packs.Add(1)
+		go func() {
+			defer packs.Done()
+			defer func() { <-s.slots }()
+
+			if err := s.SendPack(group); err != nil {
+				s.logger.Println("Error sending pack:", err)
+			}
+		}()
+	}
+
+	packs.Wait()
+}
+
+/// Send the files as one pack object, each file is a range of the pack
+/// The files in the middle of another transition are left out, the ones opened or
+/// modified before they are truncated stay local and their range is garbage
+func (s *S3Sender) SendPack(entries []*S3NodeTable) error {
+	uuids := make([]string, len(entries))
+	for i := range entries {
+		uuids[i] = entries[i].UUID
+	}
+
+	return s.fs.states.TransitionAll(uuids, UPLOADING_STATE, s.sendPack)
+}
+
+// The transitions of the files must be running
+func (s *S3Sender) sendPack(uuids []string) error {
+	packID := uuid.New().String()
+	stagingPath := filepath.Join(s.config.GetStagingPath(), packID)
+	defer os.Remove(stagingPath)
+
+	members, err := s.writePack(uuids, stagingPath)
+	if err != nil || len(members) == 0 {
+		return err
+	}
+
+	info, err := os.Stat(stagingPath)
+	if err != nil {
+		return err
+	}
+
+	checksum, err := fileMD5(stagingPath)
+	if err != nil {
+		return err
+	}
+
+	// Recorded first, a pack left without files is removed by the repack command
+	pack := &S3PackTable{
+		ID:              packID,
+		S3RuleTablePath: s.rule.Src,
+		Server:          s.rule.Dest,
+		ObjectKey:       newPackKey(members[0].entry.S3RuleTable.UUID, packID),
+		Size:            info.Size(),
+	}
+	if err := s.orm.CreatePack(pack); err != nil {
+		return err
+	}
+
+	// A crash until the files are truncated is replayed on the next start
+	for _, member := range members {
+		intent := newPackIntent(member.entry, pack, member.length, member.checksum)
+		if err := s.orm.BeginIntent(intent); err != nil {
+			return err
+		}
+		defer s.orm.EndIntent(intent)
+	}
+
+	s.logger.Printf("Sending pack of %v files: %v -> %v", len(members), pack.ObjectKey, s.rule.Dest)
+
+	err = s.rclone.SendObject(s.rule.Dest, stagingPath, pack.ObjectKey)
+	if err == nil {
+		err = s.rclone.VerifyObject(s.rule.Dest, pack.ObjectKey, pack.Size, checksum)
+	}
+
+	if err != nil {
+		s.logger.Println("Error sending the pack", err)
+		if err != errUploadsPaused {
+			for _, member := range members {
+				s.orm.RecordFailure(member.entry, UPLOAD_INTENT, err, s.rule)
+			}
+		}
+		s.removePack(pack)
+		return err
+	}
+
+	packed := 0
+	for _, member := range members {
+		if err := s.commitPackMember(pack, member); err != nil {
+			s.logger.Printf("Leaving %v out of the pack: %v", member.entry.Path, err)
+			continue
+		}
+		s.orm.ClearFailures(member.entry.UUID, UPLOAD_INTENT)
+		packed++
+	}
+
+	// Every file changed during the upload
+	if packed == 0 {
+		s.removePack(pack)
+	}
+
+	return nil
+}
+
+// Copy the local files to the pack, the files open or gone are left out
+func (s *S3Sender) writePack(uuids []string, stagingPath string) ([]*packMember, error) {
+	file, err := os.Create(stagingPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	members := make([]*packMember, 0, len(uuids))
+	offset := int64(0)
+
+	for _, entryUUID := range uuids {
+
+		// The file may have changed since the cycle started
+		entry := s.orm.GetEntryByUUID(entryUUID)
+		if entry == nil || !entry.Local {
+			continue
+		}
+
+		names := s.orm.GetNames(entry)
+		if s.fs.hasOpenFHs(names) {
+			continue
+		}
+
+		member, err := appendPackMember(file, entry, offset)
+		if err != nil {
+			s.logger.Printf("Leaving %v out of the pack: %v", entry.Path, err)
+
+			// The pack ends with the previous file
+			if err := file.Truncate(offset); err != nil {
+				return nil, err
+			}
+			if _, err := file.Seek(offset, io.SeekStart); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		member.names = names
+		members = append(members, member)
+		offset += member.length
+	}
+
+	return members, file.Sync()
+}
+
+// Copy the file at the end of the pack
+func appendPackMember(pack *os.File, entry *S3NodeTable, offset int64) (*packMember, error) {
+	file, err := os.Open(entry.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := md5.New()
+	length, err := io.Copy(io.MultiWriter(pack, hash), file)
+	if err != nil {
+		return nil, err
+	}
+
+	if length != info.Size() {
+		return nil, errFileChanged
+	}
+
+	return &packMember{
+		entry:    entry,
+		offset:   offset,
+		length:   length,
+		checksum: hex.EncodeToString(hash.Sum(nil)),
+		modTime:  info.ModTime(),
+	}, nil
+}
+
+// Mark the file remote in the pack then truncate it, unless it changed since it was copied
+func (s *S3Sender) commitPackMember(pack *S3PackTable, member *packMember) error {
+	entry := member.entry
+
+	// The file cannot be opened until it is truncated
+	err := s.fs.whileClosed(member.names, func() error {
+
+		// The pack may miss the last writes
+		if after, err := os.Stat(entry.Path); err != nil || after.Size() != member.length || !after.ModTime().Equal(member.modTime) {
+			return errFileChanged
+		}
+
+		s.orm.SendToPack(entry, pack, member.offset, member.length, member.checksum)
+
+		// Lets the rebuild command find the range of the file
+		packed := *entry
+		packed.PackID, packed.PackOffset, packed.PackLength = pack.ID, member.offset, member.length
+		if err := setUUIDXattr(entry.Path, entry.UUID); err != nil {
+			s.logger.Println("Error keeping the UUID of the file", err)
+		}
+		if err := setPackXattr(entry.Path, &packed); err != nil {
+			s.logger.Println("Error keeping the pack of the file", err)
+		}
+
+		if err := syscall.Truncate(entry.Path, 0); err != nil {
+			s.logger.Println("Error truncating the file locally", err)
+			return err
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// The outdated copy kept by the last recall, the range of a packed one is reclaimed by the repack command
+	if entry.Server != "" && entry.PackID == "" {
+		if previousKey, err := s.rclone.GetObjectKey(entry); err == nil {
+			if err := s.rclone.RemoveObject(entry.Server, previousKey); err != nil {
+				s.logger.Println("Error removing the outdated object", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Remove a pack no file uses, the repack command removes it if this fails
+func (s *S3Sender) removePack(pack *S3PackTable) {
+	if err := s.rclone.RemoveObject(pack.Server, pack.ObjectKey); err != nil {
+		s.logger.Println("Error removing the pack", err)
+		return
+	}
+	s.orm.DeletePack(pack)
+}
+
+// Rewrite the pack with the files still using it, or remove it when none does
+// Returns the number of bytes reclaimed, the pack is kept when its garbage is below the ratio
+func repackPack(config *ConfigPath, orm *SQlite, rclone *RClone, pack *S3PackTable, garbageRatio float64) (int64, error) {
+	members := orm.GetPackMembers(pack)
+
+	live := int64(0)
+	for i := range members {
+		live += members[i].PackLength
+	}
+
+	if len(members) == 0 {
+		if err := rclone.RemoveObject(pack.Server, pack.ObjectKey); err != nil {
+			return 0, err
+		}
+		orm.DeletePack(pack)
+		return pack.Size, nil
+	}
+
+	if float64(pack.Size-live) < garbageRatio*float64(pack.Size) {
+		return 0, nil
+	}
+
+	oldPath := filepath.Join(config.GetStagingPath(), pack.ID)
+	defer os.Remove(oldPath)
+
+	if err := rclone.DownloadObject(pack.Server, pack.ObjectKey, oldPath); err != nil {
+		return 0, err
+	}
+
+	newPack := &S3PackTable{
+		ID:              uuid.New().String(),
+		S3RuleTablePath: pack.S3RuleTablePath,
+		Server:          pack.Server,
+	}
+	newPack.ObjectKey = filepath.Join(filepath.Dir(pack.ObjectKey), newPack.ID)
+
+	newPath := filepath.Join(config.GetStagingPath(), newPack.ID)
+	defer os.Remove(newPath)
+
+	offsets, err := copyPackMembers(oldPath, newPath, members)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(newPath)
+	if err != nil {
+		return 0, err
+	}
+	newPack.Size = info.Size()
+
+	checksum, err := fileMD5(newPath)
+	if err != nil {
+		return 0, err
+	}
+
+	// Recorded first, a crash leaves a pack without files which the next repack removes
+	if err := orm.CreatePack(newPack); err != nil {
+		return 0, err
+	}
+
+	if err := rclone.SendObject(newPack.Server, newPath, newPack.ObjectKey); err != nil {
+		return 0, err
+	}
+
+	if err := rclone.VerifyObject(newPack.Server, newPack.ObjectKey, newPack.Size, checksum); err != nil {
+		return 0, err
+	}
+
+	if err := orm.MovePackMembers(pack, newPack, offsets); err != nil {
+		return 0, err
+	}
+
+	// Lets the rebuild command find the new range of the files
+	for _, entry := range orm.GetPackMembers(newPack) {
+		if err := setPackXattr(entry.Path, &entry); err != nil {
+			log.Printf("Error keeping the pack of %v: %v", entry.Path, err)
+		}
+	}
+
+	// The files which left the pack during the copy do not use it anymore
+	if len(orm.GetPackMembers(pack)) > 0 {
+		return 0, fmt.Errorf("Pack %v is still used", pack.ID)
+	}
+
+	if err := rclone.RemoveObject(pack.Server, pack.ObjectKey); err != nil {
+		return 0, err
+	}
+	orm.DeletePack(pack)
+
+	return pack.Size - newPack.Size, nil
+}
+
+// Copy the ranges of the files from the old pack to the new one, returns their new offsets by UUID
+// The files with a checksum are verified, a corrupted range fails the repack
+func copyPackMembers(oldPath, newPath string, members []S3NodeTable) (map[string]int64, error) {
+	from, err := os.Open(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	defer from.Close()
+
+	to, err := os.Create(newPath)
+	if err != nil {
+		return nil, err
+	}
+	defer to.Close()
+
+	offsets := make(map[string]int64, len(members))
+	offset := int64(0)
+
+	for i := range members {
+		member := &members[i]
+
+		hash := md5.New()
+		section := io.NewSectionReader(from, member.PackOffset, member.PackLength)
+		length, err := io.Copy(io.MultiWriter(to, hash), section)
+		if err != nil {
+			return nil, err
+		}
+
+		if length != member.PackLength {
+			return nil, fmt.Errorf("Pack has %d bytes instead of %d for %s", length, member.PackLength, member.Path)
+		}
+
+		if member.Checksum != "" && hex.EncodeToString(hash.Sum(nil)) != member.Checksum {
+			return nil, fmt.Errorf("Pack range of %s does not match its checksum", member.Path)
+		}
+
+		offsets[member.UUID] = offset
+		offset += length
+	}
+
+	return offsets, to.Sync()
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Default prefetch settings, used for the fields left empty in the config
+const (
+	defaultPrefetchConcurrency = 2
+	defaultPrefetchDepth       = 4
+	defaultPrefetchBudget      = "512Mo"
+)
+
+// The directories opened last are kept to detect the scans, the ones not opened
+// for this long are forgotten once more than prefetchMaxDirs are kept
+const (
+	prefetchScanTimeout = time.Minute
+	prefetchMaxDirs     = 1024
+)
+
+// Prefetch settings of a rule
+type PrefetchConfig struct {
+	// number of recalls running at the same time
+	Concurrency int `json:"concurrency,omitempty"`
+
+	// number of files, or of blocks for streamed reads, recalled ahead
+	Depth int `json:"depth,omitempty"`
+
+	// maximum number of bytes being recalled at the same time, size parameter such as "512Mo"
+	Budget string `json:"budget,omitempty"`
+}
+
+func (config *PrefetchConfig) IsValid() error {
+	if config.Concurrency < 0 || config.Depth < 0 {
+		return fmt.Errorf("Prefetch concurrency and depth must be positive")
+	}
+
+	if config.Budget != "" {
+		param, err := ParseSizeParameter(config.Budget)
+		if err != nil {
+			return err
+		}
+		if _, err := param.Bytes(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The last file opened in a directory
+type openedFile struct {
+	name string
+	at   time.Time
+}
+
+// Recalls in the background the blocks that will likely be read next, for the rules streaming
+// their reads only: prefetching a whole file would download it while the scan may stop first
+// Two patterns are detected:
+// * a directory scan: files of a directory opened one after the other in name order (`cat dir/*`)
+// * a sequential read: a streamed file read where the previous read stopped
+type Prefetcher struct {
+	fs     *S3FS
+	depth  int
+	budget int64
+	slots  chan bool
+	logger func(format string, v ...interface{})
+
+	mutex         sync.Mutex
+	inFlight      map[string]bool
+	inFlightBytes int64
+
+	// last file opened by directory
+	lastOpened map[string]openedFile
+
+	// end of the last read by file
+	lastReadEnd map[string]int64
+}
+
+// Returns nil when the rule does not prefetch
+func NewPrefetcher(fs *S3FS, rule *Rule) *Prefetcher {
+	config := rule.Prefetch
+	if config == nil || !rule.StreamReads {
+		return nil
+	}
+
+	concurrency := config.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultPrefetchConcurrency
+	}
+
+	depth := config.Depth
+	if depth == 0 {
+		depth = defaultPrefetchDepth
+	}
+
+	budgetParam := config.Budget
+	if budgetParam == "" {
+		budgetParam = defaultPrefetchBudget
+	}
+
+	// Validated by Config.IsValid
+	param, _ := ParseSizeParameter(budgetParam)
+	budget, _ := param.Bytes()
+
+	return &Prefetcher{
+		fs:          fs,
+		depth:       depth,
+		budget:      budget,
+		slots:       make(chan bool, concurrency),
+		logger:      fs.logger.Printf,
+		inFlight:    make(map[string]bool),
+		lastOpened:  make(map[string]openedFile),
+		lastReadEnd: make(map[string]int64),
+	}
+}
+
+/// A file was opened, prefetch the first block of the next files of the directory if it is being scanned
+func (p *Prefetcher) Opened(path string) {
+	if p == nil {
+		return
+	}
+
+	dir, name := filepath.Split(path)
+	now := time.Now()
+
+	p.mutex.Lock()
+	last, ok := p.lastOpened[dir]
+	p.lastOpened[dir] = openedFile{name: name, at: now}
+	if len(p.lastOpened) > prefetchMaxDirs {
+		for openedDir, opened := range p.lastOpened {
+			if now.Sub(opened.at) > prefetchScanTimeout {
+				delete(p.lastOpened, openedDir)
+			}
+		}
+	}
+	p.mutex.Unlock()
+
+	if !ok || name <= last.name || now.Sub(last.at) > prefetchScanTimeout {
+		return
+	}
+
+	nodes, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	// os.ReadDir sorts the nodes by name, like the shell globs
+	prefetched := 0
+	for _, node := range nodes {
+		if prefetched >= p.depth {
+			break
+		}
+
+		if node.Name() <= name || !node.Type().IsRegular() {
+			continue
+		}
+
+		entry := p.fs.orm.GetEntry(p.fs.mountPath, filepath.Join(dir, node.Name()), 0)
+		if entry == nil || entry.Local {
+			continue
+		}
+
+		// The first block only, the file is hydrated if it is read further
+		size := entry.Size
+		if size > streamBlockSize {
+			size = streamBlockSize
+		}
+
+		p.schedule(entry.Path, size, func() error {
+			return p.fs.ReadRange(entry.Path, 0, streamBlockSize)
+		})
+		prefetched++
+	}
+}
+
+/// A streamed file was read, prefetch the next blocks if it is read sequentially
+func (p *Prefetcher) Read(entry *S3NodeTable, off int64, size int) {
+	if p == nil {
+		return
+	}
+
+	end := off + int64(size)
+
+	p.mutex.Lock()
+	lastEnd, ok := p.lastReadEnd[entry.Path]
+	p.lastReadEnd[entry.Path] = end
+	p.mutex.Unlock()
+
+	if !ok || off != lastEnd || end >= entry.Size {
+		return
+	}
+
+	// Start from the next block, the current one is already being read
+	nextBlock := (end + streamBlockSize - 1) / streamBlockSize
+	for block := nextBlock; block < nextBlock+int64(p.depth) && block*streamBlockSize < entry.Size; block++ {
+		blockOff := block * streamBlockSize
+		p.schedule(fmt.Sprintf("%s@%d", entry.Path, block), streamBlockSize, func() error {
+			_, err := p.fs.streamRemote(entry, blockOff, streamBlockSize)
+			return err
+		})
+	}
+}
+
+/// Forget the file, it was closed or removed
+func (p *Prefetcher) Forget(path string) {
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.lastReadEnd, path)
+}
+
+/// Run the recall in the background if it fits in the budget and is not running already
+func (p *Prefetcher) schedule(key string, size int64, recall func() error) {
+	p.mutex.Lock()
+	if p.inFlight[key] || p.inFlightBytes+size > p.budget {
+		p.mutex.Unlock()
+		return
+	}
+	p.inFlight[key] = true
+	p.inFlightBytes += size
+	p.mutex.Unlock()
+
+	go func() {
+		p.slots <- true
+		defer func() { <-p.slots }()
+
+		if err := recall(); err != nil {
+			p.logger("Error while prefetching '%v': %v", key, err)
+		}
+
+		p.mutex.Lock()
+		delete(p.inFlight, key)
+		p.inFlightBytes -= size
+		p.mutex.Unlock()
+	}()
+}
@@ -4,13 +4,20 @@ package main
 import "C"
 
 import (
+	"bytes"
 	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/estebangarcia21/subprocess"
 )
@@ -18,29 +25,76 @@ import (
 //go:embed rclone
 var rcloneBinary []byte
 
+// Exit codes of rclone when the remote path does not exist
+const (
+	RCLONE_DIR_NOT_FOUND  = 3
+	RCLONE_FILE_NOT_FOUND = 4
+)
+
+// User of the remote control of the uploads, their password is drawn for each upload
+const rcloneRCUser = "s3-agent"
+
+var errUploadsPaused = errors.New("The uploads are paused")
+
 type RClone struct {
 	config     *Config
 	configPath *ConfigPath
 	logger     *log.Logger
+
+	// bytes per second the rule may send at a time, 0 when unlimited (See bandwidthPool)
+	uploadCap func(time.Time) int64
+
+	// running uploads, stopped while the uploads are paused
+	uploads      map[*os.Process]bool
+	uploadsMutex sync.Mutex
+	paused       bool
+
+	// longest time the uploads stay stopped by a pause, 0 until they are resumed
+	// the uploads still stopped then are cancelled, the files stay local and are sent
+	// again from the start by the first cycle of the next window (See UploadConfig.MaxPause)
+	maxPause time.Duration
+
+	// number of pauses so far, the uploads cancelled by the last one
+	pauses    int
+	cancelled map[*os.Process]bool
 }
 
-func NewRClone(configPath *ConfigPath) *RClone {
-	rclonePath := configPath.GetRCloneBinaryPath()
-	file, err := os.Create(rclonePath)
-	if err != nil {
-		panic(err)
+// Written by the first rclone of the process, the uploads may run it afterwards
+var rcloneBinaryOnce sync.Once
+
+// The binary is written aside then renamed, the one in place may be running:
+// truncating it fails with ETXTBSY
+func writeRCloneBinary(rclonePath string) error {
+	tmpPath := rclonePath + ".tmp"
+	if err := os.WriteFile(tmpPath, rcloneBinary, 0700); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0700); err != nil {
+		return err
 	}
+	return os.Rename(tmpPath, rclonePath)
+}
 
-	file.Write(rcloneBinary)
-	file.Close()
-	os.Chmod(rclonePath, 0700)
+func NewRClone(configPath *ConfigPath) *RClone {
+	rcloneBinaryOnce.Do(func() {
+		if err := writeRCloneBinary(configPath.GetRCloneBinaryPath()); err != nil {
+			panic(err)
+		}
+	})
 
 	config, err := LoadConfig(configPath.GetAgentConfigPath())
 	if err != nil {
 		panic(err)
 	}
 
-	return &RClone{configPath: configPath, config: config, logger: configPath.NewLogger("RCLONE: ")}
+	return &RClone{
+		configPath: configPath,
+		config:     config,
+		logger:     configPath.NewLogger("RCLONE: "),
+		uploads:    make(map[*os.Process]bool),
+		cancelled:  make(map[*os.Process]bool),
+		uploadCap:  func(time.Time) int64 { return 0 },
+	}
 }
 
 /// Run the rclone binary with the given arguments.
@@ -58,26 +112,75 @@ func (r *RClone) Run(opts ...subprocess.Option) (int, string, string, error) {
 		return -1, "", "", err
 	}
 
+	// The callers must never take a failed transfer for a successful one
+	if pop.ExitCode() != 0 {
+		return pop.ExitCode(), string(pop.Stdout()), string(pop.Stderr()),
+			fmt.Errorf("Rclone failed with exit code %d: %s", pop.ExitCode(), strings.TrimSpace(string(pop.Stderr())))
+	}
+
 	return pop.ExitCode(), string(pop.Stdout()), string(pop.Stderr()), nil
 }
 
-func (r *RClone) getS3Path(server, ruleId, fromPath string) (string, error) {
+// Key of the object in the bucket built from the path of the file
+// Used by the dry-run mode and by the files uploaded before the keys were stable
+func (r *RClone) getPathObjectKey(ruleId, fromPath string) (string, error) {
 
-	serverPath := ""
 	relativePath := ""
-
-	bucket := r.config.RCloneConfig[server]["bucket"]
 	fsPath := filepath.Join(r.configPath.folder, ruleId)
 
 	if IsSubpath(fsPath, fromPath, &relativePath) {
-		serverPath = filepath.Join(bucket, "s3-agent", ruleId, relativePath)
-	} else if IsSubpath(r.config.Rules[0].Src, fromPath, &relativePath) {
-		serverPath = filepath.Join(bucket, "s3-agent", ruleId, relativePath)
-	} else {
-		return "", fmt.Errorf("Could not find relative path for : %s", fromPath)
+		return filepath.Join("s3-agent", ruleId, relativePath), nil
 	}
 
-	return server + ":" + serverPath, nil
+	// The path may be the one of a mountpoint (dry-run mode)
+	for _, rule := range r.config.Rules {
+		if IsSubpath(rule.Src, fromPath, &relativePath) {
+			return filepath.Join("s3-agent", ruleId, relativePath), nil
+		}
+	}
+
+	return "", fmt.Errorf("Could not find relative path for : %s", fromPath)
+}
+
+// Key of the object of a tracked file built from the UUID of its entry
+// It does not depend on the path of the file so it survives the renames
+func newObjectKey(entry *S3NodeTable) string {
+	return filepath.Join("s3-agent", entry.S3RuleTable.UUID, "objects", entry.UUID)
+}
+
+// Key of the object of a tracked file: the one stored at upload time, or the
+// one built from the path for the files uploaded before the keys were stable
+func (r *RClone) GetObjectKey(entry *S3NodeTable) (string, error) {
+	if entry.ObjectKey != "" {
+		return entry.ObjectKey, nil
+	}
+
+	return r.getPathObjectKey(entry.S3RuleTable.UUID, entry.Path)
+}
+
+func (r *RClone) getKeyS3Path(server, key string) string {
+	bucket := r.config.RCloneConfig[server]["bucket"]
+	return server + ":" + filepath.Join(bucket, key)
+}
+
+func (r *RClone) getS3Path(server, ruleId, fromPath string) (string, error) {
+
+	key, err := r.getPathObjectKey(ruleId, fromPath)
+	if err != nil {
+		return "", err
+	}
+
+	return r.getKeyS3Path(server, key), nil
+}
+
+func (r *RClone) getEntryS3Path(server string, entry *S3NodeTable) (string, error) {
+
+	key, err := r.GetObjectKey(entry)
+	if err != nil {
+		return "", err
+	}
+
+	return r.getKeyS3Path(server, key), nil
 }
 
 func (r *RClone) CopyTo(server, uuid, fromPath string) error {
@@ -86,6 +189,10 @@ func (r *RClone) CopyTo(server, uuid, fromPath string) error {
 		return err
 	}
 
+	return r.copyTo(fromPath, s3Path)
+}
+
+func (r *RClone) copyTo(fromPath, s3Path string) error {
 	ret, _, stderr, err := r.Run(subprocess.Args("copyto", fromPath, s3Path))
 	if ret != 0 {
 		r.logger.Printf("Rclone copyto failed with exit code: %d\n%s", ret, stderr)
@@ -101,7 +208,17 @@ func (r *RClone) Delete(server, uuid, path string) error {
 		return err
 	}
 
+	return r.delete(s3Path)
+}
+
+func (r *RClone) delete(s3Path string) error {
 	ret, _, stderr, err := r.Run(subprocess.Args("delete", s3Path))
+
+	// Deleting an object twice is fine, the replayed intents may do it
+	if ret == RCLONE_DIR_NOT_FOUND || ret == RCLONE_FILE_NOT_FOUND {
+		return nil
+	}
+
 	if ret != 0 {
 		r.logger.Printf("Rclone delete failed with exit code: %d\n%s", ret, stderr)
 		return err
@@ -110,27 +227,181 @@ func (r *RClone) Delete(server, uuid, path string) error {
 	return nil
 }
 
-func (r *RClone) Send(server, fromPath string, entry *S3NodeTable) error {
+/// Upload the file to the stable key of its entry and returns the key
+func (r *RClone) Send(server, fromPath string, entry *S3NodeTable) (string, error) {
 	if !entry.Local {
-		r.logger.Println("Warning: Asking RClone to send a remote file")
-		return nil
+		return "", fmt.Errorf("Asking RClone to send a remote file: %s", entry.Path)
+	}
+
+	key := newObjectKey(entry)
+	return key, r.SendObject(server, fromPath, key)
+}
+
+/// Upload the file to the key, the uploads can be paused and their bandwidth limited
+/// Returns errUploadsPaused when the uploads are paused or the pause cancelled the upload
+func (r *RClone) SendObject(server, fromPath, key string) error {
+	args := []string{"copyto", fromPath, r.getKeyS3Path(server, key), "--config", r.configPath.GetRCloneConfigPath()}
+
+	r.uploadsMutex.Lock()
+
+	// Started by the first cycle of the next window
+	if r.paused {
+		r.uploadsMutex.Unlock()
+		return errUploadsPaused
+	}
+
+	// The rate of the upload changes with the other uploads running, it is sent through
+	// the remote control of the process, the credentials are not shown by ps
+	share, err := uploadBandwidth.start(r)
+	if err != nil {
+		r.uploadsMutex.Unlock()
+		return err
+	}
+	defer uploadBandwidth.finish(share)
+	args = append(args, "--bwlimit", formatRate(share.rate), "--rc", "--rc-addr", share.addr)
+
+	// The process is kept to be paused and resumed
+	var stderr bytes.Buffer
+	cmd := exec.Command(r.configPath.GetRCloneBinaryPath(), args...)
+	cmd.Env = append(os.Environ(), "RCLONE_RC_USER="+rcloneRCUser, "RCLONE_RC_PASS="+share.password)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		r.uploadsMutex.Unlock()
+		return err
+	}
+	r.uploads[cmd.Process] = true
+	r.uploadsMutex.Unlock()
+
+	err = cmd.Wait()
+
+	r.uploadsMutex.Lock()
+	cancelled := r.cancelled[cmd.Process]
+	delete(r.uploads, cmd.Process)
+	delete(r.cancelled, cmd.Process)
+	r.uploadsMutex.Unlock()
+
+	if cancelled {
+		r.logger.Printf("Rclone copyto cancelled after a pause of %v", r.maxPause)
+		return errUploadsPaused
+	}
+
+	if err != nil {
+		r.logger.Printf("Rclone copyto failed: %v\n%s", err, stderr.String())
+		return fmt.Errorf("Rclone copyto failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+/// Limit the bandwidth of the uploads sent by Send, the cap is read again when it may change
+/// The uploads of the rule share the cap with each other and the global cap with the other rules
+func (r *RClone) SetUploadCap(uploadCap func(time.Time) int64) {
+	r.uploadCap = uploadCap
+}
+
+/// Bound the pauses of the uploads, 0 keeps them stopped until they are resumed
+func (r *RClone) SetMaxPause(maxPause time.Duration) {
+	r.uploadsMutex.Lock()
+	defer r.uploadsMutex.Unlock()
+	r.maxPause = maxPause
+}
+
+/// Stop the running uploads, the new ones are refused until they are resumed
+/// The uploads still paused after the max pause are cancelled, if any
+/// Returns false if they were paused already
+func (r *RClone) PauseUploads() bool {
+	return r.signalUploads(true, syscall.SIGSTOP)
+}
+
+/// Continue the paused uploads, returns false if they were not paused
+func (r *RClone) ResumeUploads() bool {
+	return r.signalUploads(false, syscall.SIGCONT)
+}
+
+func (r *RClone) signalUploads(paused bool, signal os.Signal) bool {
+	r.uploadsMutex.Lock()
+	defer r.uploadsMutex.Unlock()
+
+	if r.paused == paused {
+		return false
+	}
+
+	r.paused = paused
+	if paused && r.maxPause > 0 {
+		r.pauses++
+		pause := r.pauses
+		time.AfterFunc(r.maxPause, func() { r.cancelPausedUploads(pause) })
+	}
+
+	// The paused uploads leave their part of the global cap to the other rules,
+	// the resumed ones are told their rate once they answer again
+	if paused {
+		uploadBandwidth.setPaused(r, true)
 	}
 
-	return r.CopyTo(server, entry.S3RuleTable.UUID, fromPath)
+	for process := range r.uploads {
+		if r.cancelled[process] {
+			continue
+		}
+		if err := process.Signal(signal); err != nil {
+			r.logger.Printf("Cannot signal the upload %v: %v", process.Pid, err)
+		}
+	}
+
+	if !paused {
+		uploadBandwidth.setPaused(r, false)
+	}
+	return true
 }
 
-func (r *RClone) Download(entry *S3NodeTable) error {
+// Kill the uploads stopped by the pause, unless they were resumed since
+func (r *RClone) cancelPausedUploads(pause int) {
+	r.uploadsMutex.Lock()
+	defer r.uploadsMutex.Unlock()
+
+	if !r.paused || r.pauses != pause {
+		return
+	}
+
+	for process := range r.uploads {
+		if r.cancelled[process] {
+			continue
+		}
+		r.cancelled[process] = true
+		if err := process.Kill(); err != nil {
+			r.logger.Printf("Cannot cancel the upload %v: %v", process.Pid, err)
+		}
+	}
+}
+
+/// Copy the remote object of the entry to toPath, the object is left on the server
+/// Only the range of the file is read from a pack
+func (r *RClone) Download(entry *S3NodeTable, toPath string) error {
 	if entry.Local {
 		r.logger.Println("Warning: Asking RClone to download a local file")
 		return nil
 	}
 
-	s3Path, err := r.getS3Path(entry.Server, entry.S3RuleTable.UUID, entry.Path)
+	s3Path, err := r.getEntryS3Path(entry.Server, entry)
 	if err != nil {
 		return err
 	}
 
-	ret, _, stderr, err := r.Run(subprocess.Args("moveto", s3Path, entry.Path))
+	if entry.PackID != "" {
+		return r.downloadRange(s3Path, entry.PackOffset, entry.PackLength, toPath)
+	}
+
+	return r.download(s3Path, toPath)
+}
+
+/// Copy the object to toPath, the object is left on the server
+func (r *RClone) DownloadObject(server, key, toPath string) error {
+	return r.download(r.getKeyS3Path(server, key), toPath)
+}
+
+func (r *RClone) download(s3Path, toPath string) error {
+	ret, _, stderr, err := r.Run(subprocess.Args("copyto", s3Path, toPath))
 	if ret != 0 {
 		r.logger.Printf("Rclone download failed with exit code: %d\n%s", ret, stderr)
 		return err
@@ -139,37 +410,180 @@ func (r *RClone) Download(entry *S3NodeTable) error {
 	return nil
 }
 
-func (r *RClone) Remove(entry *S3NodeTable) error {
-	if entry.Local {
-		r.logger.Println("Warning: Asking RClone to remove a local file")
+// Copy count bytes of the object from offset to toPath
+// The output is binary, it cannot go through Run which reads it as text
+func (r *RClone) downloadRange(s3Path string, offset, count int64, toPath string) error {
+	file, err := os.Create(toPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// rclone reads the whole object when the count is 0
+	if count == 0 {
 		return nil
 	}
 
-	return r.Delete(entry.Server, entry.S3RuleTable.UUID, entry.Path)
+	var stderr bytes.Buffer
+	cmd := exec.Command(r.configPath.GetRCloneBinaryPath(), "cat",
+		"--offset", strconv.FormatInt(offset, 10), "--count", strconv.FormatInt(count, 10),
+		s3Path, "--config", r.configPath.GetRCloneConfigPath())
+	cmd.Stdout = file
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		r.logger.Printf("Rclone cat failed: %v\n%s", err, stderr.String())
+		return err
+	}
+
+	return file.Sync()
 }
 
-func (r *RClone) GetSize(entry *S3NodeTable, server string) (int64, error) {
-	s3Path, err := r.getS3Path(server, entry.S3RuleTable.UUID, entry.Path)
+/// Move the object of a file uploaded before the keys were stable to its stable key
+/// The move is done by the server, the data does not go through the agent
+func (r *RClone) MigrateObject(entry *S3NodeTable) (string, error) {
+	if entry.ObjectKey != "" {
+		return entry.ObjectKey, nil
+	}
+
+	oldS3Path, err := r.getEntryS3Path(entry.Server, entry)
 	if err != nil {
-		return -1, err
+		return "", err
 	}
 
-	ret, stdout, stderr, err := r.Run(subprocess.Args("size", s3Path))
+	key := newObjectKey(entry)
+	ret, _, stderr, err := r.Run(subprocess.Args("moveto", oldS3Path, r.getKeyS3Path(entry.Server, key)))
 	if ret != 0 {
-		r.logger.Printf("Rclone size failed with exit code: %d\n%s", ret, stderr)
-		return -1, err
+		r.logger.Printf("Rclone moveto failed with exit code: %d\n%s", ret, stderr)
+		return "", err
 	}
 
-	regex := regexp.MustCompile(`((?P<Size>\d+) Byte)`)
-	match := regex.FindStringSubmatch(stdout)
-	if len(match) == 0 {
-		return -1, fmt.Errorf("Could not find size in output: %s", stdout)
+	return key, nil
+}
+
+/// Read count bytes of a remote file from offset
+/// The output is binary, it cannot go through Run which reads it as text
+func (r *RClone) ReadRange(entry *S3NodeTable, offset, count int64) ([]byte, error) {
+	s3Path, err := r.getEntryS3Path(entry.Server, entry)
+	if err != nil {
+		return nil, err
 	}
 
-	size, err := strconv.ParseInt(match[2], 10, 64)
+	// The file is a range of its pack
+	offset += entry.PackOffset
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(r.configPath.GetRCloneBinaryPath(), "cat",
+		"--offset", strconv.FormatInt(offset, 10), "--count", strconv.FormatInt(count, 10),
+		s3Path, "--config", r.configPath.GetRCloneConfigPath())
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		r.logger.Printf("Rclone cat failed: %v\n%s", err, stderr.String())
+		return nil, err
+	}
+
+	if int64(stdout.Len()) != count {
+		return nil, fmt.Errorf("Rclone cat returned %d bytes instead of %d", stdout.Len(), count)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func (r *RClone) Remove(entry *S3NodeTable) error {
+	if entry.Server == "" {
+		r.logger.Println("Warning: Asking RClone to remove a file without remote object")
+		return nil
+	}
+
+	// The pack is shared with other files, the repack command reclaims the range of the file
+	if entry.PackID != "" {
+		return nil
+	}
+
+	s3Path, err := r.getEntryS3Path(entry.Server, entry)
+	if err != nil {
+		return err
+	}
+
+	return r.delete(s3Path)
+}
+
+/// Remove an object which is not tracked by any entry
+func (r *RClone) RemoveObject(server, key string) error {
+	return r.delete(r.getKeyS3Path(server, key))
+}
+
+/// Find the object of a file whose entry was rebuilt, returns its key, its size and its MD5 checksum
+/// The stable key is tried first, then the one built from the path
+func (r *RClone) FindObject(entry *S3NodeTable, server string) (string, int64, string, error) {
+
+	keys := []string{newObjectKey(entry)}
+	if key, err := r.getPathObjectKey(entry.S3RuleTable.UUID, entry.Path); err == nil {
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		if object, err := r.statObject(r.getKeyS3Path(server, key)); err == nil && object.Size > 0 {
+			return key, object.Size, object.Hashes["md5"], nil
+		}
+	}
+
+	return "", -1, "", fmt.Errorf("Could not find the remote object of: %s", entry.Path)
+}
+
+/// Returns the size of the object
+func (r *RClone) ObjectSize(server, key string) (int64, error) {
+	object, err := r.statObject(r.getKeyS3Path(server, key))
 	if err != nil {
 		return -1, err
 	}
+	return object.Size, nil
+}
+
+/// Check that the object has the size and the MD5 checksum of the local file it was sent from
+/// Only the size is checked when the server does not give the checksum of the object
+func (r *RClone) VerifyObject(server, key string, size int64, checksum string) error {
+	object, err := r.statObject(r.getKeyS3Path(server, key))
+	if err != nil {
+		return err
+	}
+
+	if object.Size != size {
+		return fmt.Errorf("Remote object %s has size %d instead of %d", key, object.Size, size)
+	}
+
+	if remoteChecksum := object.Hashes["md5"]; remoteChecksum == "" {
+		r.logger.Printf("Warning: No checksum for the remote object %s, only its size was verified", key)
+	} else if !strings.EqualFold(remoteChecksum, checksum) {
+		return fmt.Errorf("Remote object %s has checksum %s instead of %s", key, remoteChecksum, checksum)
+	}
+
+	return nil
+}
+
+// An object as listed by rclone lsjson
+type remoteObject struct {
+	Size   int64
+	Hashes map[string]string
+}
+
+func (r *RClone) statObject(s3Path string) (*remoteObject, error) {
+	ret, stdout, stderr, err := r.Run(subprocess.Args("lsjson", "--files-only", "--hash", "--hash-type", "MD5", s3Path))
+	if ret != 0 {
+		r.logger.Printf("Rclone lsjson failed with exit code: %d\n%s", ret, stderr)
+		return nil, err
+	}
+
+	var objects []remoteObject
+	if err := json.Unmarshal([]byte(stdout), &objects); err != nil {
+		return nil, fmt.Errorf("Could not parse the output of lsjson: %v", err)
+	}
+
+	if len(objects) != 1 {
+		return nil, fmt.Errorf("Could not find the remote object: %s", s3Path)
+	}
 
-	return size, nil
+	return &objects[0], nil
 }
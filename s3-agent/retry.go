@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Default retry settings, used for the fields left empty in the config
+const (
+	defaultRetryAttempts   = 10
+	defaultRetryBackoff    = "1m"
+	defaultRetryMaxBackoff = "24h"
+)
+
+// Retry settings of the failed transfers of a rule
+// The delay before the next attempt doubles after each failure, the files failing
+// max-attempts times in a row are quarantined: the sender stops trying them
+type RetryConfig struct {
+	// failures before the file is quarantined
+	MaxAttempts int `json:"max-attempts,omitempty"`
+
+	// delay after the first failure and maximum delay, durations such as "1m" or "24h"
+	Backoff    string `json:"backoff,omitempty"`
+	MaxBackoff string `json:"max-backoff,omitempty"`
+}
+
+func (config *RetryConfig) IsValid() error {
+	if config.MaxAttempts < 0 {
+		return fmt.Errorf("Retry attempts must be positive")
+	}
+
+	for _, value := range []string{config.Backoff, config.MaxBackoff} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("Invalid retry backoff: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Number of failures in a row before the file is quarantined
+func (rule *Rule) GetRetryAttempts() int {
+	if rule.Retry == nil || rule.Retry.MaxAttempts == 0 {
+		return defaultRetryAttempts
+	}
+	return rule.Retry.MaxAttempts
+}
+
+// Delay before the next attempt after the given number of failures in a row
+func (rule *Rule) GetRetryDelay(attempts int) time.Duration {
+	backoffParam, maxBackoffParam := defaultRetryBackoff, defaultRetryMaxBackoff
+	if rule.Retry != nil && rule.Retry.Backoff != "" {
+		backoffParam = rule.Retry.Backoff
+	}
+	if rule.Retry != nil && rule.Retry.MaxBackoff != "" {
+		maxBackoffParam = rule.Retry.MaxBackoff
+	}
+
+	// Validated by Config.IsValid
+	delay, _ := time.ParseDuration(backoffParam)
+	maxBackoff, _ := time.ParseDuration(maxBackoffParam)
+
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxBackoff {
+		return maxBackoff
+	}
+	return delay
+}
+
+// Can the sender try the file again, the failure is nil when the last attempt succeeded
+func (failure *S3FailureTable) CanRetry(now time.Time) bool {
+	return failure == nil || !failure.Quarantined && !now.Before(failure.NextRetry)
+}
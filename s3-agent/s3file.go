@@ -40,6 +40,12 @@ type S3File struct {
 
 	// Opening flags in case we have to reopen it
 	Flags uint32
+
+	// The file was marked modified through this handle already
+	dirty bool
+
+	// The file was created or written through this handle, its offload is scheduled on release
+	written bool
 }
 
 var _ = (fs.FileHandle)((*S3File)(nil))
@@ -60,8 +66,10 @@ var _ = (fs.FileAllocater)((*S3File)(nil))
 
 func (f *S3File) Read(ctx context.Context, buf []byte, off int64) (res fuse.ReadResult, errno syscall.Errno) {
 
-	// The user asked the real data, we need to download the file or verify the cache
-	if err := f.root.fs.Download(f.Path); err != nil {
+	f.root.fs.Access(f.Path)
+
+	// The user asked the real data, we need to download the file, fetch the range or verify the cache
+	if err := f.root.fs.ReadRange(f.Path, off, len(buf)); err != nil {
 		return nil, fs.ToErrno(err)
 	}
 
@@ -80,10 +88,31 @@ func (f *S3File) Write(ctx context.Context, data []byte, off int64) (uint32, sys
 
 	f.Mutex.Lock()
 	defer f.Mutex.Unlock()
+
+	if err := f.modified(); err != nil {
+		return 0, fs.ToErrno(err)
+	}
+
 	n, err := syscall.Pwrite(f.Fd, data, off)
 	return uint32(n), fs.ToErrno(err)
 }
 
+// Mark the file modified once per handle, the handles are closed before the file is sent again
+// The mutex must be held
+func (f *S3File) modified() error {
+	if f.dirty {
+		return nil
+	}
+
+	if err := f.root.fs.Modified(f.Path); err != nil {
+		return err
+	}
+
+	f.dirty = true
+	f.written = true
+	return nil
+}
+
 func (f *S3File) Release(ctx context.Context) syscall.Errno {
 	f.Mutex.Lock()
 	defer f.Mutex.Unlock()
@@ -95,6 +124,10 @@ func (f *S3File) Release(ctx context.Context) syscall.Errno {
 
 		err := syscall.Close(f.Fd)
 		f.Fd = -1
+
+		if f.written {
+			f.root.fs.Closed(f.Path)
+		}
 		return fs.ToErrno(err)
 	}
 	return syscall.EBADF
@@ -133,6 +166,15 @@ func (f *S3File) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.Attr
 }
 
 func (f *S3File) setAttr(ctx context.Context, in *fuse.SetAttrIn) syscall.Errno {
+
+	// The user ask to truncate the file, so we need to download the file.
+	// The download locks the handles of the file, this one included
+	if _, ok := in.GetSize(); ok {
+		if err := f.root.fs.Download(f.Path); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+
 	f.Mutex.Lock()
 	defer f.Mutex.Unlock()
 	var errno syscall.Errno
@@ -181,8 +223,7 @@ func (f *S3File) setAttr(ctx context.Context, in *fuse.SetAttrIn) syscall.Errno
 
 	if sz, ok := in.GetSize(); ok {
 
-		// The user ask to truncate the file, so we need to download the file.
-		if err := f.root.fs.Download(f.Path); err != nil {
+		if err := f.modified(); err != nil {
 			return fs.ToErrno(err)
 		}
 
@@ -24,6 +24,10 @@ func (f *S3File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint3
 	f.Mutex.Lock()
 	defer f.Mutex.Unlock()
 
+	if err := f.modified(); err != nil {
+		return fs.ToErrno(err)
+	}
+
 	err := syscall.Fallocate(f.Fd, mode, int64(off), int64(sz))
 	if err != nil {
 		return fs.ToErrno(err)
@@ -164,7 +164,11 @@ func (n *S3Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.
 func (n *S3Node) Rmdir(ctx context.Context, name string) syscall.Errno {
 	p := filepath.Join(n.path(), name)
 	err := syscall.Rmdir(p)
-	return fs.ToErrno(err)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+
+	return fs.ToErrno(n.RootData.fs.Rmdir(p))
 }
 
 func (n *S3Node) Unlink(ctx context.Context, name string) syscall.Errno {
@@ -190,7 +194,11 @@ func (n *S3Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbe
 	}
 
 	err := syscall.Rename(p1, p2)
-	return fs.ToErrno(err)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+
+	return fs.ToErrno(n.RootData.fs.Renamed(p1, p2))
 }
 
 func (n *S3Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
@@ -241,10 +249,15 @@ func (n *S3Node) Symlink(ctx context.Context, target, name string, out *fuse.Ent
 func (n *S3Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
 
 	p := filepath.Join(n.path(), name)
-	err := syscall.Link(filepath.Join(n.RootData.Path, target.EmbeddedInode().Path(nil)), p)
+	targetPath := filepath.Join(n.RootData.Path, target.EmbeddedInode().Path(nil))
+	err := syscall.Link(targetPath, p)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
+	if err := n.RootData.fs.Link(targetPath, p); err != nil {
+		syscall.Unlink(p)
+		return nil, fs.ToErrno(err)
+	}
 	st := syscall.Stat_t{}
 	if err := syscall.Lstat(p, &st); err != nil {
 		syscall.Unlink(p)
@@ -260,6 +273,8 @@ func (n *S3Node) Link(ctx context.Context, target fs.InodeEmbedder, name string,
 func (n *S3Node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
 	p := n.path()
 
+	n.RootData.fs.Access(p)
+
 	if err := n.RootData.fs.Download(p); err != nil {
 		return nil, fs.ToErrno(err)
 	}
@@ -281,6 +296,23 @@ func (n *S3Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuse
 
 	flags = flags &^ syscall.O_APPEND
 	p := n.path()
+
+	// No upload can commit the file until its handle is registered: the truncate or the
+	// writes of the open would be undone by the next download
+	n.RootData.fs.beginOpen(p)
+	defer n.RootData.fs.endOpen(p)
+
+	// Truncated by the open itself, the remote file must be local first
+	// or the next download would bring its content back, its bytes are not needed
+	if flags&syscall.O_TRUNC != 0 {
+		if err := n.RootData.fs.Truncated(p); err != nil {
+			return nil, 0, fs.ToErrno(err)
+		}
+		if err := n.RootData.fs.Modified(p); err != nil {
+			return nil, 0, fs.ToErrno(err)
+		}
+	}
+
 	f, err := syscall.Open(p, int(flags), 0)
 	if err != nil {
 		return nil, 0, fs.ToErrno(err)
@@ -291,6 +323,9 @@ func (n *S3Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuse
 		return nil, 0, fs.ToErrno(err)
 	}
 
+	n.RootData.fs.Access(p)
+	n.RootData.fs.Opened(p)
+
 	return lf, 0, 0
 }
 
@@ -394,6 +429,10 @@ func (n *S3Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrI
 				return fs.ToErrno(err)
 			}
 
+			if err := n.RootData.fs.Modified(p); err != nil {
+				return fs.ToErrno(err)
+			}
+
 			if err := syscall.Truncate(p, int64(sz)); err != nil {
 				return fs.ToErrno(err)
 			}
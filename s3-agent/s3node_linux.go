@@ -8,32 +8,164 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"path/filepath"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
+	"golang.org/x/exp/slices"
 	"golang.org/x/sys/unix"
 )
 
 func (n *S3Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if slices.Contains(stateXattrs, attr) {
+		value, ok := n.RootData.fs.StateXattrs(n.path())[attr]
+		if !ok {
+			return 0, syscall.ENODATA
+		}
+		return copyXattr([]byte(value), dest)
+	}
+
+	// Internal to the agent
+	if slices.Contains(internalXattrs, attr) {
+		return 0, syscall.ENODATA
+	}
+
+	if attr == actionXattr {
+		progress := n.RootData.fs.ActionProgress(n.path())
+		if progress == "" {
+			return 0, syscall.ENODATA
+		}
+
+		// The first call of getxattr usually only asks for the size
+		sz, errno := copyXattr([]byte(progress), dest)
+		if errno == fs.OK && len(dest) > 0 {
+			n.RootData.fs.ForgetAction(n.path())
+		}
+		return sz, errno
+	}
+
 	sz, err := unix.Lgetxattr(n.path(), attr, dest)
 	return uint32(sz), fs.ToErrno(err)
 }
 
 func (n *S3Node) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	if slices.Contains(stateXattrs, attr) || slices.Contains(internalXattrs, attr) {
+		return syscall.EPERM
+	}
+
+	// Actions are not stored, only their progress can be read
+	if attr == actionXattr {
+		action, err := parseAction(data)
+		if err != nil {
+			return syscall.EINVAL
+		}
+
+		if err := n.RootData.fs.StartAction(n.path(), action); err != nil {
+			n.RootData.fs.logger.Println(err)
+			switch {
+			case errors.Is(err, errActionRunning):
+				return syscall.EBUSY
+			case errors.Is(err, errActionNoSender):
+				return syscall.ENOTSUP
+			default:
+				return fs.ToErrno(err)
+			}
+		}
+
+		return fs.OK
+	}
+
+	if attr == pinnedXattr {
+		pinned, err := parseXattrBool(data)
+		if err != nil {
+			return syscall.EINVAL
+		}
+
+		return n.setPin(pinned, func() error {
+			return unix.Lsetxattr(n.path(), attr, data, int(flags))
+		})
+	}
+
 	err := unix.Lsetxattr(n.path(), attr, data, int(flags))
 	return fs.ToErrno(err)
 }
 
+// The pin is kept on the loopback too, so that a rebuild of the DB finds it
+// The attribute is written first and restored if the DB cannot follow, the DB never
+// holds a pin the loopback does not (See FsckCmd)
+func (n *S3Node) setPin(pinned bool, write func() error) syscall.Errno {
+	p := n.path()
+	previous, _ := getXattrString(p, pinnedXattr)
+
+	if err := write(); err != nil {
+		return fs.ToErrno(err)
+	}
+
+	if err := n.RootData.fs.Pin(p, pinned); err != nil {
+		if previous != "" {
+			unix.Lsetxattr(p, pinnedXattr, []byte(previous), 0)
+		} else {
+			unix.Lremovexattr(p, pinnedXattr)
+		}
+		return fs.ToErrno(err)
+	}
+
+	return fs.OK
+}
+
 func (n *S3Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	if slices.Contains(stateXattrs, attr) || slices.Contains(internalXattrs, attr) {
+		return syscall.EPERM
+	}
+
+	if attr == pinnedXattr {
+		return n.setPin(false, func() error {
+			return unix.Lremovexattr(n.path(), attr)
+		})
+	}
+
 	err := unix.Lremovexattr(n.path(), attr)
 	return fs.ToErrno(err)
 }
 
 func (n *S3Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
-	sz, err := unix.Llistxattr(n.path(), dest)
-	return uint32(sz), fs.ToErrno(err)
+	p := n.path()
+
+	sz, err := unix.Llistxattr(p, nil)
+	if err != nil {
+		return 0, fs.ToErrno(err)
+	}
+
+	loopbackList := make([]byte, sz)
+	sz, err = unix.Llistxattr(p, loopbackList)
+	if err != nil {
+		return 0, fs.ToErrno(err)
+	}
+
+	// Hide the internal attributes
+	list := make([]byte, 0, sz)
+	for _, attr := range bytes.Split(loopbackList[:sz], []byte{0}) {
+		if len(attr) > 0 && !slices.Contains(internalXattrs, string(attr)) {
+			list = append(append(list, attr...), 0)
+		}
+	}
+
+	// Add the virtual attributes of the tracked files, null terminated like the other ones
+	xattrs := n.RootData.fs.StateXattrs(p)
+	for _, attr := range stateXattrs {
+		if _, ok := xattrs[attr]; ok {
+			list = append(append(list, attr...), 0)
+		}
+	}
+
+	if n.RootData.fs.ActionProgress(p) != "" {
+		list = append(append(list, actionXattr...), 0)
+	}
+
+	return copyXattr(list, dest)
 }
 
 func (n *S3Node) renameExchange(name string, newparent fs.InodeEmbedder, newName string) syscall.Errno {
@@ -68,11 +200,21 @@ func (n *S3Node) renameExchange(name string, newparent fs.InodeEmbedder, newName
 		return syscall.EBUSY
 	}
 
-	if err := n.RootData.fs.Rename(filepath.Join(n.path(), name), filepath.Join(p2, newName)); err != nil {
+	path1, path2 := filepath.Join(n.path(), name), filepath.Join(p2, newName)
+
+	// Both paths change
+	if err := n.RootData.fs.Rename(path1, path2); err != nil {
+		return fs.ToErrno(err)
+	}
+	if err := n.RootData.fs.Rename(path2, path1); err != nil {
 		return fs.ToErrno(err)
 	}
 
-	return fs.ToErrno(unix.Renameat2(fd1, name, fd2, newName, unix.RENAME_EXCHANGE))
+	if err := unix.Renameat2(fd1, name, fd2, newName, unix.RENAME_EXCHANGE); err != nil {
+		return fs.ToErrno(err)
+	}
+
+	return fs.ToErrno(n.RootData.fs.Exchange(path1, path2))
 }
 
 func (n *S3Node) CopyFileRange(ctx context.Context, fhIn fs.FileHandle,
@@ -96,6 +238,13 @@ func (n *S3Node) CopyFileRange(ctx context.Context, fhIn fs.FileHandle,
 		return 0, fs.ToErrno(err)
 	}
 
+	lfOut.Mutex.Lock()
+	err := lfOut.modified()
+	lfOut.Mutex.Unlock()
+	if err != nil {
+		return 0, fs.ToErrno(err)
+	}
+
 	signedOffIn := int64(offIn)
 	signedOffOut := int64(offOut)
 	count, err := unix.CopyFileRange(lfIn.Fd, &signedOffIn, lfOut.Fd, &signedOffOut, int(len), int(flags))
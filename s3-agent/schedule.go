@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Period of the checks opening and closing the upload windows, the windows are set to the minute
+const windowCheckPeriod = 20 * time.Second
+
+// A daily time range when the rule may send files
+// The range spans midnight when the end is before the start, "22:00" to "06:00" for example
+type UploadWindow struct {
+	// start and end of the window, such as "22:00"
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	// bytes per second sent by the rule during the window, size parameter such as "50Mo"
+	// the bandwidth of the rule when empty
+	Bandwidth string `json:"bandwidth,omitempty"`
+}
+
+// Minutes since midnight of a "15:04" time
+func parseDayMinutes(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return -1, fmt.Errorf("Invalid time '%s': expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (window *UploadWindow) IsValid() error {
+	start, err := parseDayMinutes(window.Start)
+	if err != nil {
+		return err
+	}
+
+	end, err := parseDayMinutes(window.End)
+	if err != nil {
+		return err
+	}
+
+	if start == end {
+		return fmt.Errorf("Upload window %s-%s is empty", window.Start, window.End)
+	}
+
+	if _, err := parseSizeBytes(window.Bandwidth); err != nil {
+		return fmt.Errorf("Invalid window bandwidth: %v", err)
+	}
+
+	return nil
+}
+
+// Is the time in the window, the start is included and the end excluded
+// The window must have been validated by Config.IsValid
+func (window *UploadWindow) contains(t time.Time) bool {
+	start, _ := parseDayMinutes(window.Start)
+	end, _ := parseDayMinutes(window.End)
+	minutes := t.Hour()*60 + t.Minute()
+
+	if start < end {
+		return start <= minutes && minutes < end
+	}
+	return start <= minutes || minutes < end
+}
+
+// Can the rule send files at this time, a rule without window always can
+func (rule *Rule) IsUploadOpen(t time.Time) bool {
+	if rule.Upload == nil || len(rule.Upload.Windows) == 0 {
+		return true
+	}
+
+	for i := range rule.Upload.Windows {
+		if rule.Upload.Windows[i].contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Bytes per second the rule may send at this time, 0 when unlimited
+// The bandwidth of the window containing the time, the one of the rule outside of the windows:
+// the uploads still running when a window closes are paused (See S3Sender.watchWindows)
+func (rule *Rule) UploadBandwidth(t time.Time) int64 {
+	if rule.Upload == nil {
+		return 0
+	}
+
+	bandwidth := rule.Upload.Bandwidth
+	for i := range rule.Upload.Windows {
+		if window := &rule.Upload.Windows[i]; window.Bandwidth != "" && window.contains(t) {
+			bandwidth = window.Bandwidth
+			break
+		}
+	}
+
+	// Validated by Config.IsValid
+	limit, _ := parseSizeBytes(bandwidth)
+	return limit
+}
+
+// Pause the uploads of the rule when its windows close, resume them when one opens
+// The rclone processes are stopped, not cancelled. The server drops their connections
+// meanwhile: once resumed, rclone retries the request the pause interrupted. The parts of
+// a multipart upload sent before the pause are kept, a file smaller than the upload cutoff
+// of rclone is sent again whole. With a max pause, the uploads still stopped then are
+// cancelled and the first cycle of the next window sends their files again from the start.
+func (s *S3Sender) watchWindows() {
+	ticker := time.NewTicker(windowCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		// The cap of the rule changes with the windows
+		uploadBandwidth.Update()
+
+		if s.rule.IsUploadOpen(time.Now()) {
+			if s.rclone.ResumeUploads() {
+				s.logger.Println("Upload window opened, resuming the uploads")
+
+				// The files left local while the window was closed, the cron may not run for long
+				go s.Cycle()
+			}
+		} else if s.rclone.PauseUploads() {
+			s.logger.Println("Upload window closed, pausing the uploads")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			s.rclone.ResumeUploads()
+			return
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"container/heap"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A file waiting to become eligible
+type offloadItem struct {
+	path  string
+	due   time.Time
+	index int
+}
+
+// The files ordered by due time, the first one is the next to send (See container/heap)
+type offloadQueue []*offloadItem
+
+func (q offloadQueue) Len() int           { return len(q) }
+func (q offloadQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+
+func (q offloadQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *offloadQueue) Push(x interface{}) {
+	item := x.(*offloadItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *offloadQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	item.index = -1
+	return item
+}
+
+// Sends the files of a rule when they become eligible, without walking all the entries
+// The filesystem hooks queue the files created, written or renamed at the time the rule
+// sends them (See Rule.EligibleAt), the cycles of the cron only sweep the files the
+// scheduler cannot see coming: the files changed outside of the mountpoint, the conditions
+// which do not become true with time, the upload windows opening. The cycles skip the
+// files queued, the scheduler checks them again when they are due.
+// The due times are kept in memory, the local files are queued again on startup.
+type OffloadScheduler struct {
+	sender *S3Sender
+
+	mutex sync.Mutex
+	queue offloadQueue
+	items map[string]*offloadItem
+
+	// Wakes the loop up when a file is queued, it may be due before the first one
+	wake chan bool
+}
+
+// Returns nil when the rule only sends files on its cycles, the rules with a budget do
+func NewOffloadScheduler(sender *S3Sender) *OffloadScheduler {
+	if sender.fs == nil || sender.budgetBytes > 0 || sender.budgetFiles > 0 {
+		return nil
+	}
+
+	return &OffloadScheduler{
+		sender: sender,
+		items:  make(map[string]*offloadItem),
+		wake:   make(chan bool, 1),
+	}
+}
+
+/// Send the files when they are due until the sender is stopped
+func (q *OffloadScheduler) Run() {
+	if q == nil {
+		return
+	}
+
+	// The files left local by the previous run
+	var entries []S3NodeTable
+	q.sender.orm.db.Model(&S3NodeTable{}).Where("Local = ?", true).Find(&entries)
+	for i := range entries {
+		if entries[i].S3RuleTablePath == q.sender.rule.Src {
+			q.scheduleEntry(entries[i].Path, &entries[i])
+		}
+	}
+
+	for {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if due, ok := q.next(); ok {
+			timer = time.NewTimer(time.Until(due))
+			timeout = timer.C
+		}
+
+		select {
+		case <-timeout:
+		case <-q.wake:
+		case <-q.sender.stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		// The uploads share the workers of the cycles
+		for path, ok := q.popDue(time.Now()); ok; path, ok = q.popDue(time.Now()) {
+			select {
+			case q.sender.slots <- true:
+			case <-q.sender.stop:
+				return
+			}
+
+			go func(path string) {
+				defer func() { <-q.sender.slots }()
+				q.sender.offload(path)
+			}(path)
+		}
+	}
+}
+
+/// Queue the file at the time the rule sends it, forget it when the rule does not send it by itself
+func (q *OffloadScheduler) Schedule(path string) {
+	if q == nil {
+		return
+	}
+
+	// The entry of a new file may still be batched
+	q.scheduleEntry(path, q.sender.orm.GetEntry(q.sender.fs.mountPath, path, 0))
+}
+
+func (q *OffloadScheduler) scheduleEntry(path string, entry *S3NodeTable) {
+	if q == nil {
+		return
+	}
+
+	if !IsRegFile(path) || entry != nil && !entry.Local {
+		q.Forget(path)
+		return
+	}
+
+	due, ok := q.sender.rule.EligibleAt(path, entry)
+	if !ok {
+		q.Forget(path)
+		return
+	}
+
+	// Validated by Config.IsValid
+	if delay, _ := q.sender.rule.GetSettleDelay(); delay > 0 {
+		if info, err := os.Stat(path); err == nil && info.ModTime().Add(delay).After(due) {
+			due = info.ModTime().Add(delay)
+		}
+	}
+
+	q.push(path, due)
+}
+
+/// Queue the file at the given time, whatever the rule
+func (q *OffloadScheduler) push(path string, due time.Time) {
+	if q == nil {
+		return
+	}
+
+	q.mutex.Lock()
+	if item, ok := q.items[path]; ok {
+		item.due = due
+		heap.Fix(&q.queue, item.index)
+	} else {
+		item := &offloadItem{path: path, due: due}
+		heap.Push(&q.queue, item)
+		q.items[path] = item
+	}
+	q.mutex.Unlock()
+
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+/// Is the file queued, the cycles leave it to the scheduler
+func (q *OffloadScheduler) Holds(path string) bool {
+	if q == nil {
+		return false
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	_, ok := q.items[path]
+	return ok
+}
+
+/// Forget the file, it was removed
+func (q *OffloadScheduler) Forget(path string) {
+	if q == nil {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if item, ok := q.items[path]; ok {
+		heap.Remove(&q.queue, item.index)
+		delete(q.items, path)
+	}
+}
+
+/// Move the queued files of the renamed file or directory, they keep their due times
+/// A renamed file is queued again, the rule may treat its new path differently
+func (q *OffloadScheduler) Renamed(oldPath, newPath string) {
+	if q == nil {
+		return
+	}
+
+	q.Forget(newPath)
+
+	q.mutex.Lock()
+	q.move(q.under(oldPath), oldPath, newPath)
+	q.mutex.Unlock()
+
+	if IsRegFile(newPath) {
+		q.Schedule(newPath)
+	}
+}
+
+/// Swap the queued files of the exchanged files or directories
+func (q *OffloadScheduler) Exchange(path1, path2 string) {
+	if q == nil {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	items1, items2 := q.under(path1), q.under(path2)
+	for _, item := range append(items1, items2...) {
+		delete(q.items, item.path)
+	}
+
+	q.move(items1, path1, path2)
+	q.move(items2, path2, path1)
+}
+
+// The queued files named path or under the path, the mutex must be held
+func (q *OffloadScheduler) under(path string) []*offloadItem {
+	if item, ok := q.items[path]; ok {
+		return []*offloadItem{item}
+	}
+
+	items := make([]*offloadItem, 0)
+	prefix := path + "/"
+	for itemPath, item := range q.items {
+		if strings.HasPrefix(itemPath, prefix) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Rename the items from under oldPath to under newPath, the mutex must be held
+func (q *OffloadScheduler) move(items []*offloadItem, oldPath, newPath string) {
+	for _, item := range items {
+		if q.items[item.path] == item {
+			delete(q.items, item.path)
+		}
+	}
+
+	for _, item := range items {
+		item.path = newPath + strings.TrimPrefix(item.path, oldPath)
+
+		// The file of the replaced directory
+		if replaced, ok := q.items[item.path]; ok {
+			heap.Remove(&q.queue, replaced.index)
+		}
+		q.items[item.path] = item
+	}
+}
+
+// Due time of the first file
+func (q *OffloadScheduler) next() (time.Time, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.queue) == 0 {
+		return time.Time{}, false
+	}
+	return q.queue[0].due, true
+}
+
+// Remove and return the first file if it is due
+func (q *OffloadScheduler) popDue(now time.Time) (string, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.queue) == 0 || q.queue[0].due.After(now) {
+		return "", false
+	}
+
+	item := heap.Pop(&q.queue).(*offloadItem)
+	delete(q.items, item.path)
+	return item.path, true
+}
@@ -1,13 +1,93 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sync"
 	"syscall"
+	"time"
 )
 
+var (
+	errFileInUse   = errors.New("The file is open")
+	errFileChanged = errors.New("The file changed during the upload")
+)
+
+// Default upload settings, used for the fields left empty in the config
+const defaultUploadConcurrency = 4
+
+// Upload settings of a rule
+type UploadConfig struct {
+	// number of files sent at the same time
+	Concurrency int `json:"concurrency,omitempty"`
+
+	// bytes per second sent by the rule, size parameter such as "10Mo"
+	Bandwidth string `json:"bandwidth,omitempty"`
+
+	// maximum number of bytes and of files sent by a cycle, the other files wait for the next cycles
+	Budget      string `json:"budget,omitempty"`
+	BudgetFiles int    `json:"budget-files,omitempty"`
+
+	// daily time ranges when files can be sent, at any time when empty (See schedule.go)
+	// Example: [{"start": "22:00", "end": "06:00", "bandwidth": "50Mo"}, {"start": "09:00", "end": "18:00", "bandwidth": "5Mo"}]
+	Windows []UploadWindow `json:"windows,omitempty"`
+
+	// longest time the uploads running when a window closes stay paused, duration such as "30m"
+	// they wait for the next window when empty, the file of each one is held by its upload meanwhile
+	MaxPause string `json:"max-pause,omitempty"`
+}
+
+func (config *UploadConfig) IsValid() error {
+	if config.Concurrency < 0 || config.BudgetFiles < 0 {
+		return fmt.Errorf("Upload concurrency and file budget must be positive")
+	}
+
+	if _, err := parseSizeBytes(config.Bandwidth); err != nil {
+		return fmt.Errorf("Invalid upload bandwidth: %v", err)
+	}
+
+	if _, err := parseSizeBytes(config.Budget); err != nil {
+		return fmt.Errorf("Invalid upload budget: %v", err)
+	}
+
+	for i := range config.Windows {
+		if err := config.Windows[i].IsValid(); err != nil {
+			return err
+		}
+	}
+
+	if config.MaxPause != "" {
+		if maxPause, err := time.ParseDuration(config.MaxPause); err != nil || maxPause <= 0 {
+			return fmt.Errorf("Invalid upload max pause '%s': expected a positive duration", config.MaxPause)
+		}
+	}
+
+	return nil
+}
+
+// Number of files the rule sends at the same time
+func (rule *Rule) GetUploadConcurrency() int {
+	if rule.Upload == nil || rule.Upload.Concurrency == 0 {
+		return defaultUploadConcurrency
+	}
+	return rule.Upload.Concurrency
+}
+
+// Longest time the uploads of the rule stay paused, 0 until the next window opens
+func (rule *Rule) GetUploadMaxPause() time.Duration {
+	if rule.Upload == nil || rule.Upload.MaxPause == "" {
+		return 0
+	}
+
+	// Validated by Config.IsValid
+	maxPause, _ := time.ParseDuration(rule.Upload.MaxPause)
+	return maxPause
+}
+
 type S3Sender struct {
 	rule            *Rule
 	fs              *S3FS
@@ -17,6 +97,19 @@ type S3Sender struct {
 	logger          *log.Logger
 	orm             *SQlite
 	rclone          *RClone
+
+	// Held by the running cycle, the ticks firing meanwhile are dropped
+	cycleMutex sync.Mutex
+
+	// One per upload running, shared by the cycles and the scheduler
+	slots chan bool
+
+	// Sends the files when they become eligible, nil if the rule only sends files on its cycles
+	scheduler *OffloadScheduler
+
+	// Budget of a cycle, 0 when unlimited (Validated by Config.IsValid)
+	budgetBytes int64
+	budgetFiles int
 }
 
 func NewS3Sender(rule *Rule, fs *S3FS, excludePattern []string, config *ConfigPath, orm *SQlite) (*S3Sender, error) {
@@ -30,6 +123,7 @@ func NewS3Sender(rule *Rule, fs *S3FS, excludePattern []string, config *ConfigPa
 		logger:          config.NewLogger("SEND: " + rule.Src + " | "),
 		orm:             orm,
 		rclone:          NewRClone(config),
+		slots:           make(chan bool, rule.GetUploadConcurrency()),
 	}
 
 	// Compile regexps
@@ -42,20 +136,46 @@ func NewS3Sender(rule *Rule, fs *S3FS, excludePattern []string, config *ConfigPa
 		s.excludePatterns[i] = exp
 	}
 
+	if rule.Upload != nil {
+		s.budgetBytes, _ = parseSizeBytes(rule.Upload.Budget)
+		s.budgetFiles = rule.Upload.BudgetFiles
+	}
+
+	s.rclone.SetUploadCap(rule.UploadBandwidth)
+	s.rclone.SetMaxPause(rule.GetUploadMaxPause())
+	s.scheduler = NewOffloadScheduler(s)
+
 	return s, nil
 }
 
+/// Start the scheduler, and pausing and resuming the uploads of the rule
+/// Must run once every filesystem is mounted, the uploads start right away
+func (s *S3Sender) Start() {
+	if s.rule.Upload != nil && len(s.rule.Upload.Windows) > 0 {
+		go s.watchWindows()
+	}
+
+	go s.scheduler.Run()
+}
+
+/// Stop pausing and resuming the uploads of the rule, and the scheduler
+func (s *S3Sender) Stop() {
+	close(s.stop)
+}
+
 func (s *S3Sender) DryRunCycle(uuid string) {
 
 	s.logger.Println("Running Dry Run SEND Cycle")
 
+	filter := NewPathFilter(s.rule.Src, s.rule)
+
 	filepath.Walk(s.rule.Src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		if !info.IsDir() && !s.isPatternExcluded(path) {
-			if s.rule.MustBeRemote(path) {
+		if !info.IsDir() && !s.isPatternExcluded(path) && !filter.IsExcluded(path) {
+			if s.rule.MustBeRemote(path, nil) {
 				s.logger.Printf("Sending file: %v -> %v", path, s.rule.Dest)
 
 				if err := s.rclone.CopyTo(s.rule.Dest, uuid, path); err != nil {
@@ -78,33 +198,183 @@ func (s *S3Sender) DryRunCycle(uuid string) {
 
 func (s *S3Sender) Cycle() {
 
-	s.logger.Println("Running SEND Cycle")
+	// A cycle can outlast the cron period, the next one would walk the same files
+	if !s.cycleMutex.TryLock() {
+		s.logger.Println("Skipping SEND Cycle: the previous one is still running")
+		return
+	}
+	defer s.cycleMutex.Unlock()
 
-	if len(s.orm.batch) > 0 {
-		s.orm.db.Create(&s.orm.batch)
-		s.orm.batch = make([]*S3NodeTable, 0)
+	// The new entries are registered whatever the windows
+	s.orm.FlushBatch()
+
+	// The running uploads are paused, the new ones wait for the next window
+	if !s.rule.IsUploadOpen(time.Now()) {
+		s.logger.Println("Skipping SEND Cycle: outside of the upload windows")
+		return
 	}
 
+	s.logger.Println("Running SEND Cycle")
+
 	var entries []S3NodeTable
 	s.orm.db.Model(&S3NodeTable{}).Where("Local = ?", true).Preload("S3RuleTable").Find(&entries)
 
-	for _, entry := range entries {
+	// Read the .s3ignore files, the pins and the links once per cycle
+	filter := NewPathFilter(s.fs.loopbackPath, s.rule)
+	pins := s.orm.GetPins()
+	links := s.orm.GetLinks()
+	failures := s.orm.GetFailures(UPLOAD_INTENT)
+	now := time.Now()
+
+	// The workers send the files handed by the loop below
+	jobs := make(chan *S3NodeTable)
+	var workers sync.WaitGroup
+
+	for i := 0; i < s.rule.GetUploadConcurrency(); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for entry := range jobs {
+				s.slots <- true
+				if err := s.SendRemote(entry); err != nil {
+					s.logger.Println("Error sending remote:", err)
+				}
+				<-s.slots
+			}
+		}()
+	}
+
+	defer workers.Wait()
+	defer close(jobs)
+
+	sentFiles := 0
+	sentBytes := int64(0)
+
+	// The small files are sent in packs once the walk is over
+	packed := make([]*S3NodeTable, 0)
+
+	for i := range entries {
+		entry := &entries[i]
 		if entry.S3RuleTablePath != s.rule.Src {
 			continue
 		}
 
-		if s.isPatternExcluded(entry.Path) {
+		// Already queued, the scheduler checks the file again once it is due
+		if s.scheduler.Holds(entry.Path) {
+			continue
+		}
+
+		// A file linked more than once stays local when one of its names must
+		names := append([]string{entry.Path}, links[entry.UUID]...)
+		if s.isExcluded(filter, names) || isPinned(pins, names...) {
+			continue
+		}
+
+		// Files still written are sent once they are closed and settled
+		if s.fs.hasOpenFHs(names) || s.isSettling(entry.Path) {
+			continue
+		}
+
+		// The failing files wait for their backoff, the quarantined ones for an offload action
+		if !failures[entry.UUID].CanRetry(now) {
 			continue
 		}
 
-		if s.rule.MustBeRemote(entry.Path) {
-			if err := s.SendRemote(&entry); err != nil {
-				s.logger.Println("Error sending remote:", err)
+		// Sent by the scheduler once eligible, unless the rule changes its mind before
+		if !s.rule.MustBeRemote(entry.Path, entry) {
+			s.scheduler.scheduleEntry(entry.Path, entry)
+			continue
+		}
+
+		// The clean cached files are not sent, they do not use the budget
+		if !s.isCached(entry) {
+			size := int64(0)
+			if info, err := os.Stat(entry.Path); err == nil {
+				size = info.Size()
 			}
+
+			// The first file is sent even if it is larger than the budget
+			if s.budgetFiles > 0 && sentFiles >= s.budgetFiles || s.budgetBytes > 0 && sentFiles > 0 && sentBytes+size > s.budgetBytes {
+				s.logger.Printf("Budget of the cycle reached: %v files, %v bytes", sentFiles, sentBytes)
+				break
+			}
+
+			sentFiles++
+			sentBytes += size
+
+			if s.rule.IsPackable(size) {
+				packed = append(packed, entry)
+				continue
+			}
+		}
+
+		jobs <- entry
+	}
+
+	s.sendPacks(packed)
+}
+
+// Send a file queued by the scheduler, the checks of the cycles are run again
+func (s *S3Sender) offload(path string) {
+
+	// The file may have been created since the last flush
+	s.orm.FlushBatch()
+
+	// Sent by the first cycle of the next window
+	if !s.rule.IsUploadOpen(time.Now()) {
+		return
+	}
+
+	entry := s.orm.GetEntry(s.fs.mountPath, path, 0)
+	if entry == nil || !entry.Local {
+		return
+	}
+
+	names := s.orm.GetNames(entry)
+	filter := NewPathFilter(s.fs.loopbackPath, s.rule)
+	if s.isExcluded(filter, names) || isPinned(s.orm.GetPins(), names...) {
+		return
+	}
+
+	// Queued again when the handles writing it are released
+	if s.fs.hasOpenFHs(names) {
+		return
+	}
+
+	failure := s.orm.GetFailure(entry.UUID, UPLOAD_INTENT)
+	if failure.CanRetry(time.Now()) {
+
+		// Accessed or modified since it was queued
+		if s.isSettling(entry.Path) || !s.rule.MustBeRemote(entry.Path, entry) {
+			s.scheduler.scheduleEntry(path, entry)
+			return
+		}
+
+		// Packed with the other small files by the next cycle
+		if info, err := os.Stat(entry.Path); err == nil && !s.isCached(entry) && s.rule.IsPackable(info.Size()) {
+			return
 		}
+
+		err := s.SendRemote(entry)
+		if err == nil {
+			return
+		}
+		s.logger.Println("Error sending remote:", err)
+
+		failure = s.orm.GetFailure(entry.UUID, UPLOAD_INTENT)
+	}
+
+	// Queued again at the end of the backoff, the quarantined files are left to the status command
+	if failure != nil && !failure.Quarantined {
+		s.scheduler.push(path, failure.NextRetry)
 	}
 }
 
+// The remote copy kept by the last recall is still the content of the file (See Rule.Cache)
+func (s *S3Sender) isCached(entry *S3NodeTable) bool {
+	return !entry.Dirty && entry.Server == s.rule.Dest && entry.ObjectKey != ""
+}
+
 func (s *S3Sender) SendRemote(entry *S3NodeTable) error {
 
 	// The file does not need to be tracked or the file is already remote
@@ -112,30 +382,193 @@ func (s *S3Sender) SendRemote(entry *S3NodeTable) error {
 		return nil
 	}
 
-	s.logger.Printf("Sending file: %v -> %v", entry.Path, s.rule.Dest)
+	// A file being recalled is needed right now, it is sent again on a later cycle
+	err := s.fs.states.Transition(entry.UUID, UPLOADING_STATE, false, func() error {
+
+		// The file may have changed since the cycle started
+		entry := s.orm.GetEntry(s.fs.mountPath, entry.Path, 0)
+		if entry == nil || !entry.Local {
+			return nil
+		}
+
+		// Truncating an open file would empty it under the feet of the application,
+		// whichever name it was opened with
+		names := s.orm.GetNames(entry)
+		if s.fs.hasOpenFHs(names) {
+			return errFileInUse
+		}
 
-	// Lock all file handle related to the file
-	s.fs.lockFHs(entry.Path)
-	defer s.fs.unlockFHs(entry.Path)
+		// The remote copy kept by the last recall is still the content of the file
+		if s.isCached(entry) {
+			return s.evict(entry, names)
+		}
+
+		s.logger.Printf("Sending file: %v -> %v", entry.Path, s.rule.Dest)
+
+		info, err := os.Stat(entry.Path)
+		if err != nil {
+			return err
+		}
+
+		checksum, err := fileMD5(entry.Path)
+		if err != nil {
+			return err
+		}
+
+		// A crash until the file is truncated is replayed on the next start
+		intent := newUploadIntent(entry, entry.Path, s.rule.Dest, info.Size(), checksum)
+		if err := s.orm.BeginIntent(intent); err != nil {
+			return err
+		}
+		defer s.orm.EndIntent(intent)
+
+		objectKey, err := s.rclone.Send(s.rule.Dest, entry.Path, entry)
+		if err != nil {
+			s.logger.Println("Error sending the file", err)
+			return err
+		}
+
+		// The local data is only dropped once the server holds the same bytes
+		if err := s.rclone.VerifyObject(s.rule.Dest, objectKey, info.Size(), checksum); err != nil {
+			s.logger.Println("Error verifying the sent file", err)
+			if err := s.rclone.RemoveObject(s.rule.Dest, objectKey); err != nil {
+				s.logger.Println("Error removing the sent object", err)
+			}
+			return err
+		}
+
+		// The file cannot be opened until it is truncated
+		err = s.fs.whileClosed(names, func() error {
+
+			// The uploaded object may miss the last writes
+			if after, err := os.Stat(entry.Path); err != nil || after.Size() != info.Size() || !after.ModTime().Equal(info.ModTime()) {
+				return errFileChanged
+			}
+
+			s.orm.SendToServer(entry, s.rule.Dest, objectKey, info.Size(), checksum)
+
+			// Lets the rebuild command find the object of the file
+			if err := setUUIDXattr(entry.Path, entry.UUID); err != nil {
+				s.logger.Println("Error keeping the UUID of the file", err)
+			}
+
+			if err := syscall.Truncate(entry.Path, 0); err != nil {
+				s.logger.Println("Error truncating the file locally", err)
+				return err
+			}
+
+			return nil
+		})
+
+		// The file stays local and is sent again later, nothing tracks the object anymore
+		if err == errFileInUse || err == errFileChanged {
+			s.logger.Printf("Cancelling the sending of %v: %v", entry.Path, err)
+			if err := s.rclone.RemoveObject(s.rule.Dest, objectKey); err != nil {
+				s.logger.Println("Error removing the sent object", err)
+			}
+		}
+
+		// The outdated copy kept by the last recall, unless the new object replaced it
+		// The range of a packed file is reclaimed by the repack command
+		if err == nil && entry.Server != "" && entry.PackID == "" {
+			if previousKey, err := s.rclone.GetObjectKey(entry); err == nil && (entry.Server != s.rule.Dest || previousKey != objectKey) {
+				if err := s.rclone.RemoveObject(entry.Server, previousKey); err != nil {
+					s.logger.Println("Error removing the outdated object", err)
+				}
+			}
+		}
 
-	info, err := os.Stat(entry.Path)
-	if err != nil {
 		return err
+	})
+
+	switch err {
+	case errTransitionRunning:
+		return nil
+	case nil:
+		s.orm.ClearFailures(entry.UUID, UPLOAD_INTENT)
+	case errFileInUse, errFileChanged:
+		// Sent again once the file is closed and settled
+	case errUploadsPaused:
+		// Sent again by the first cycle of the next window
+	default:
+		if failure := s.orm.RecordFailure(entry, UPLOAD_INTENT, err, s.rule); failure.Quarantined {
+			s.logger.Printf("Quarantining %v after %v failed attempts", entry.Path, failure.Attempts)
+		}
 	}
+	return err
+}
 
-	if err := s.rclone.Send(s.rule.Dest, entry.Path, entry); err != nil {
-		s.logger.Println("Error sending the file", err)
+// Truncate a clean file whose remote copy was kept by the cache mode, nothing is sent
+// The transition of the file must be running
+func (s *S3Sender) evict(entry *S3NodeTable, names []string) error {
+
+	s.logger.Printf("Evicting file: %v", entry.Path)
+
+	// A crash until the file is truncated is replayed on the next start
+	intent := newEvictIntent(entry)
+	if err := s.orm.BeginIntent(intent); err != nil {
 		return err
 	}
+	defer s.orm.EndIntent(intent)
 
-	s.orm.SendToServer(entry, s.rule.Dest, info.Size())
+	// The file cannot be opened until it is truncated
+	err := s.fs.whileClosed(names, func() error {
 
-	if err := syscall.Truncate(entry.Path, 0); err != nil {
-		s.logger.Println("Error truncating the file locally", err)
-		return err
+		// Modified since the transition started
+		current := s.orm.GetEntryByUUID(entry.UUID)
+		if current == nil || !current.Local || current.Dirty {
+			return errFileChanged
+		}
+
+		if info, err := os.Stat(entry.Path); err != nil || info.Size() != entry.Size {
+			return errFileChanged
+		}
+
+		s.orm.MarkRemote(entry)
+
+		if err := setUUIDXattr(entry.Path, entry.UUID); err != nil {
+			s.logger.Println("Error keeping the UUID of the file", err)
+		}
+
+		if err := syscall.Truncate(entry.Path, 0); err != nil {
+			s.logger.Println("Error truncating the file locally", err)
+			return err
+		}
+
+		return nil
+	})
+
+	// The file was modified without going through the mountpoint, it is sent on a later cycle
+	if err == errFileChanged {
+		s.logger.Printf("Cancelling the eviction of %v: %v", entry.Path, err)
+		return s.orm.MarkDirty(entry.Path)
 	}
 
-	return nil
+	if err == errFileInUse {
+		return nil
+	}
+	return err
+}
+
+// Was the file modified more recently than the settle delay of the rule
+func (s *S3Sender) isSettling(path string) bool {
+	delay, _ := s.rule.GetSettleDelay()
+	if delay == 0 {
+		return false
+	}
+
+	info, err := os.Stat(path)
+	return err == nil && time.Since(info.ModTime()) < delay
+}
+
+func (s *S3Sender) isExcluded(filter *PathFilter, names []string) bool {
+	for _, name := range names {
+		if s.isPatternExcluded(name) || filter.IsExcluded(name) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (s *S3Sender) isPatternExcluded(path string) bool {
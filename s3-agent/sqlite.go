@@ -3,7 +3,10 @@ package main
 import (
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"gorm.io/driver/sqlite"
@@ -16,10 +19,28 @@ type S3NodeTable struct {
 	Path            string `gorm:"primaryKey"`
 	Size            int64
 	Local           bool
-	UUID            string
+	UUID            string `gorm:"index"`
 	Server          string
 	S3RuleTablePath string
 	S3RuleTable     S3RuleTable
+	LastAccess      time.Time
+	UploadedAt      time.Time
+
+	// Key of the remote object, empty for the files uploaded before the keys
+	// were built from the UUID (See RClone.GetObjectKey)
+	ObjectKey string
+
+	// Hex MD5 checksum of the content sent to remote, verified after the transfers
+	Checksum string
+
+	// The local file was modified since its remote copy was kept (See Rule.Cache)
+	Dirty bool
+
+	// Pack holding the content of a small file, empty when the file has its own object (See pack.go)
+	// ObjectKey is the key of the pack, the file is the range of PackLength bytes from PackOffset
+	PackID     string `gorm:"index"`
+	PackOffset int64
+	PackLength int64
 }
 
 /// Needed to link the local loopback filesystem
@@ -29,16 +50,92 @@ type S3RuleTable struct {
 	Path string `gorm:"primaryKey"`
 }
 
+/// The other names of the files linked more than once
+/// The entry of the file keeps one of its names, the first one it had
+type S3LinkTable struct {
+	Path string `gorm:"primaryKey"`
+	UUID string `gorm:"index"`
+}
+
+/// Files and directories that must stay local
+/// A pinned directory pins all its children, even the ones created later
+type S3PinTable struct {
+	Path string `gorm:"primaryKey"`
+}
+
+/// Write-ahead journal of the transitions of the files (See journal.go)
+/// An intent is recorded before the transition starts and removed once it is done
+type S3IntentTable struct {
+	ID   uint `gorm:"primaryKey"`
+	Kind intentKind
+
+	// UUID of the entry of the file, or of the rule for the mount intents
+	UUID string `gorm:"index"`
+
+	// Path of the file, or source of the rule for the mount intents
+	Path string
+
+	// Remote object written or read by the transition
+	Server    string
+	ObjectKey string
+
+	// Size and hex MD5 checksum of the content of the file
+	Size     int64
+	Checksum string
+
+	// The recalled file keeps its remote object
+	KeepRemote bool
+
+	// The object is a pack shared with other files, only the repack command removes it
+	PackID string
+
+	CreatedAt time.Time
+}
+
+/// Objects packing several small files (See pack.go)
+/// A pack is recorded before it is sent, the repack command removes the packs left without files
+type S3PackTable struct {
+	ID              string `gorm:"primaryKey"`
+	S3RuleTablePath string
+	Server          string
+	ObjectKey       string
+	Size            int64
+	CreatedAt       time.Time
+}
+
+/// Transfers failing in a row, retried with an exponential backoff (See retry.go)
+type S3FailureTable struct {
+	UUID string     `gorm:"primaryKey"`
+	Kind intentKind `gorm:"primaryKey"`
+
+	// Path of the file at the last failure
+	Path string
+
+	// zero when the transfer is only tried again on demand (See SQlite.RecordFailure)
+	Attempts    int
+	LastError   string
+	NextRetry   time.Time
+	Quarantined bool
+}
+
 type SQlite struct {
 	db     *gorm.DB
 	logger *log.Logger
 	config *ConfigPath
 	batch  []*S3NodeTable
+
+	// entries created by the FUSE goroutines, flushed by the sender
+	batchMutex sync.Mutex
+
+	// last accesses not yet written, FUSE goroutines record them concurrently
+	accesses      map[string]time.Time
+	accessesMutex sync.Mutex
 }
 
 func NewSQlite(config *ConfigPath) *SQlite {
 	// Personalize default db logger to ignore RecordNotFound error
-	db, err := gorm.Open(sqlite.Open(config.GetDBPath()), &gorm.Config{
+	// The workers of the senders and the FUSE goroutines write concurrently, they wait for each other
+	db, err := gorm.Open(sqlite.Open(config.GetDBPath()+"?_busy_timeout=5000"), &gorm.Config{
 		Logger: logger.New(log.New(os.Stdout, "\r\n", log.LstdFlags),
 			logger.Config{
 				SlowThreshold:             400 * time.Millisecond,
@@ -54,13 +151,19 @@ func NewSQlite(config *ConfigPath) *SQlite {
 
 	db.AutoMigrate(&S3NodeTable{})
 	db.AutoMigrate(&S3RuleTable{})
+	db.AutoMigrate(&S3PinTable{})
+	db.AutoMigrate(&S3LinkTable{})
+	db.AutoMigrate(&S3IntentTable{})
+	db.AutoMigrate(&S3FailureTable{})
+	db.AutoMigrate(&S3PackTable{})
 	os.Chmod(config.GetDBPath(), 0600)
 
 	return &SQlite{
-		db:     db,
-		logger: config.NewLogger("SQLITE: "),
-		config: config,
-		batch:  make([]*S3NodeTable, 0),
+		db:       db,
+		logger:   config.NewLogger("SQLITE: "),
+		config:   config,
+		batch:    make([]*S3NodeTable, 0),
+		accesses: make(map[string]time.Time),
 	}
 }
 
@@ -72,30 +175,164 @@ func (orm *SQlite) GetNewEntry(rulePath, path string, size int64) *S3NodeTable {
 		UUID:            uuid.New().String(),
 		Server:          "",
 		S3RuleTablePath: rulePath,
+		LastAccess:      time.Now(),
+	}
+}
+
+/// Remember the entry of a new file, the DB is updated on the next flush
+func (orm *SQlite) AddToBatch(entry *S3NodeTable) {
+	orm.batchMutex.Lock()
+	defer orm.batchMutex.Unlock()
+	orm.batch = append(orm.batch, entry)
+}
+
+/// Register the entries created by the filesystem since the last flush
+func (orm *SQlite) FlushBatch() {
+	orm.batchMutex.Lock()
+	batch := orm.batch
+	orm.batch = make([]*S3NodeTable, 0)
+	orm.batchMutex.Unlock()
+
+	if len(batch) > 0 {
+		orm.logger.Printf("Registering %v unsaved entries\n", len(batch))
+		orm.db.Create(&batch)
+	}
+
+	orm.accessesMutex.Lock()
+	accesses := orm.accesses
+	orm.accesses = make(map[string]time.Time)
+	orm.accessesMutex.Unlock()
+
+	for path, lastAccess := range accesses {
+		orm.db.Model(&S3NodeTable{}).Where("Path = ? OR UUID IN (?)", path, orm.db.Model(&S3LinkTable{}).Select("UUID").Where("Path = ?", path)).Update("LastAccess", lastAccess)
 	}
 }
 
+/// Remember that the file was accessed, the DB is updated on the next flush
+/// to keep the DB writes out of the read path
+func (orm *SQlite) RecordAccess(path string) {
+	orm.accessesMutex.Lock()
+	defer orm.accessesMutex.Unlock()
+	orm.accesses[path] = time.Now()
+}
+
 /// Returns a file entry from the database
 func (orm *SQlite) CreateEntry(rulePath, path string, size int64) *S3NodeTable {
 	entry := orm.GetNewEntry(rulePath, path, size)
 	if result := orm.db.Where("Path = ?", path).Preload("S3RuleTable").FirstOrCreate(entry); result.Error != nil {
 		return nil
 	}
+
+	// The rule is not preloaded when the entry was just created
+	if entry.S3RuleTable.Path == "" {
+		orm.db.Where("Path = ?", entry.S3RuleTablePath).First(&entry.S3RuleTable)
+	}
 	return entry
 }
 
-/// Returns a file entry from the database
+/// Returns a file entry from the database, whichever name of the file the path is
 func (orm *SQlite) GetEntry(rulePath, path string, size int64) *S3NodeTable {
 	entry := orm.GetNewEntry(rulePath, path, size)
-	if result := orm.db.Where("Path = ?", path).Preload("S3RuleTable").First(entry); result.Error != nil {
+	if result := orm.db.Where("Path = ?", path).Preload("S3RuleTable").First(entry); result.Error == nil {
+		return entry
+	}
+
+	var link S3LinkTable
+	if result := orm.db.Where("Path = ?", path).First(&link); result.Error != nil {
+		return nil
+	}
+
+	entry = &S3NodeTable{}
+	if result := orm.db.Where("UUID = ?", link.UUID).Preload("S3RuleTable").First(entry); result.Error != nil {
 		return nil
 	}
 	return entry
 }
 
+/// Returns the entries of the files having a name under the path
+func (orm *SQlite) GetSubpathEntries(path string) []S3NodeTable {
+	var entries []S3NodeTable
+	links := whereSubpath(orm.db.Model(&S3LinkTable{}), path).Select("UUID")
+	whereSubpath(orm.db, path).Or("UUID IN (?)", links).Preload("S3RuleTable").Find(&entries)
+	return entries
+}
+
+/// Register a new name of the file
+func (orm *SQlite) AddLink(entry *S3NodeTable, path string) error {
+	return orm.db.Create(&S3LinkTable{Path: path, UUID: entry.UUID}).Error
+}
+
+/// Returns the other names of the files linked more than once, by UUID
+func (orm *SQlite) GetLinks() map[string][]string {
+	var links []S3LinkTable
+	orm.db.Find(&links)
+
+	names := make(map[string][]string)
+	for _, link := range links {
+		names[link.UUID] = append(names[link.UUID], link.Path)
+	}
+	return names
+}
+
+/// Returns all the names of the file, the one of its entry first
+func (orm *SQlite) GetNames(entry *S3NodeTable) []string {
+	var links []S3LinkTable
+	orm.db.Where("UUID = ?", entry.UUID).Find(&links)
+
+	names := []string{entry.Path}
+	for _, link := range links {
+		names = append(names, link.Path)
+	}
+	return names
+}
+
 /// Tell the DB that the file is remote now
-func (orm *SQlite) SendToServer(entry *S3NodeTable, server string, size int64) {
-	orm.db.Model(entry).Where("Path = ?", entry.Path).Update("Server", server).Update("Local", false).Update("Size", size)
+/// The entry is found by UUID, the file may have been renamed during the upload
+/// The columns are written by a single statement, the journal takes a remote entry for a complete one
+func (orm *SQlite) SendToServer(entry *S3NodeTable, server, objectKey string, size int64, checksum string) {
+	orm.db.Model(&S3NodeTable{}).Where("UUID = ?", entry.UUID).Updates(map[string]interface{}{
+		"Server":     server,
+		"Local":      false,
+		"Size":       size,
+		"UploadedAt": time.Now(),
+		"ObjectKey":  objectKey,
+		"Checksum":   checksum,
+		"Dirty":      false,
+		"PackID":     "",
+		"PackOffset": 0,
+		"PackLength": 0,
+	})
+}
+
+/// Tell the DB that the file is remote now, its content is a range of the pack
+func (orm *SQlite) SendToPack(entry *S3NodeTable, pack *S3PackTable, offset, size int64, checksum string) {
+	orm.db.Model(&S3NodeTable{}).Where("UUID = ?", entry.UUID).Updates(map[string]interface{}{
+		"Server":     pack.Server,
+		"Local":      false,
+		"Size":       size,
+		"UploadedAt": time.Now(),
+		"ObjectKey":  pack.ObjectKey,
+		"Checksum":   checksum,
+		"Dirty":      false,
+		"PackID":     pack.ID,
+		"PackOffset": offset,
+		"PackLength": size,
+	})
+}
+
+/// Tell the DB that the file is remote again, its remote copy kept by the last recall is unchanged
+func (orm *SQlite) MarkRemote(entry *S3NodeTable) {
+	orm.db.Model(&S3NodeTable{}).Where("UUID = ?", entry.UUID).Updates(map[string]interface{}{"Local": false, "Dirty": false})
+}
+
+/// Tell the DB that the remote object of the file was moved to a new key
+func (orm *SQlite) SetObjectKey(entry *S3NodeTable, objectKey string) {
+	orm.db.Model(&S3NodeTable{}).Where("UUID = ?", entry.UUID).Update("ObjectKey", objectKey)
+}
+
+/// Give back its UUID to an entry rebuilt from the loopback
+func (orm *SQlite) SetEntryUUID(entry *S3NodeTable, uuid string) {
+	orm.db.Model(entry).Where("Path = ?", entry.Path).Update("UUID", uuid)
 }
 
 func (orm *SQlite) IsEntryLocal(path string) bool {
@@ -104,18 +341,304 @@ func (orm *SQlite) IsEntryLocal(path string) bool {
 	return len(entry) == 0 || entry[0].Local
 }
 
+/// Returns the entry of the file, whichever its name is now
+func (orm *SQlite) GetEntryByUUID(uuid string) *S3NodeTable {
+	var entry S3NodeTable
+	if result := orm.db.Where("UUID = ?", uuid).Preload("S3RuleTable").First(&entry); result.Error != nil {
+		return nil
+	}
+	return &entry
+}
+
+/// The file was modified, only the local files keeping a remote copy are updated
+func (orm *SQlite) MarkDirty(path string) error {
+	links := orm.db.Model(&S3LinkTable{}).Select("UUID").Where("Path = ?", path)
+	return orm.db.Model(&S3NodeTable{}).Where("(Path = ? OR UUID IN (?)) AND Local = ? AND Server <> ? AND Dirty = ?", path, links, true, "", false).Update("Dirty", true).Error
+}
+
+/// Update the size of a file found local again
+func (orm *SQlite) SetSize(entry *S3NodeTable, size int64) {
+	orm.db.Model(&S3NodeTable{}).Where("UUID = ?", entry.UUID).Update("Size", size)
+}
+
+/// Record the intent before the transition starts, the intent is written right away
+func (orm *SQlite) BeginIntent(intent *S3IntentTable) error {
+	return orm.db.Create(intent).Error
+}
+
+/// The transition of the intent is done, the DB and the disk agree again
+func (orm *SQlite) EndIntent(intent *S3IntentTable) {
+	orm.db.Where("ID = ?", intent.ID).Delete(&S3IntentTable{})
+}
+
+/// Record a failed transfer of the file, the file is quarantined after too many failures in a row
+/// Without rule the transfer has no retry schedule, it is tried again when the file is needed
+func (orm *SQlite) RecordFailure(entry *S3NodeTable, kind intentKind, err error, rule *Rule) *S3FailureTable {
+	failure := S3FailureTable{UUID: entry.UUID, Kind: kind}
+	orm.db.Where("UUID = ? AND Kind = ?", entry.UUID, kind).FirstOrInit(&failure)
+
+	failure.Path = entry.Path
+	failure.Attempts++
+	failure.LastError = err.Error()
+	if rule != nil {
+		failure.NextRetry = time.Now().Add(rule.GetRetryDelay(failure.Attempts))
+		failure.Quarantined = failure.Attempts >= rule.GetRetryAttempts()
+	}
+
+	orm.db.Save(&failure)
+	return &failure
+}
+
+/// The transfer of the file succeeded, or the file is gone
+func (orm *SQlite) ClearFailures(uuid string, kinds ...intentKind) {
+	query := orm.db.Where("UUID = ?", uuid)
+	if len(kinds) > 0 {
+		query = query.Where("Kind IN (?)", kinds)
+	}
+	query.Delete(&S3FailureTable{})
+}
+
+/// Returns the failing transfers of a kind, by UUID
+func (orm *SQlite) GetFailures(kind intentKind) map[string]*S3FailureTable {
+	var failures []S3FailureTable
+	orm.db.Where("Kind = ?", kind).Find(&failures)
+
+	byUUID := make(map[string]*S3FailureTable)
+	for i := range failures {
+		byUUID[failures[i].UUID] = &failures[i]
+	}
+	return byUUID
+}
+
+/// Returns the failing transfer of the file, nil if the last one succeeded
+func (orm *SQlite) GetFailure(uuid string, kind intentKind) *S3FailureTable {
+	var failure S3FailureTable
+	if result := orm.db.Where("UUID = ? AND Kind = ?", uuid, kind).First(&failure); result.Error != nil {
+		return nil
+	}
+	return &failure
+}
+
+/// Returns all the failing transfers, the quarantined ones first
+func (orm *SQlite) GetAllFailures() []S3FailureTable {
+	var failures []S3FailureTable
+	orm.db.Order("Quarantined DESC, Next_Retry").Find(&failures)
+	return failures
+}
+
+/// Forget the quarantined transfers, the sender tries them again, returns their count
+func (orm *SQlite) ReleaseQuarantine() int64 {
+	return orm.db.Where("Quarantined = ?", true).Delete(&S3FailureTable{}).RowsAffected
+}
+
+/// Returns the intents left by the previous run, the oldest first
+func (orm *SQlite) GetIntents() []S3IntentTable {
+	var intents []S3IntentTable
+	orm.db.Order("ID").Find(&intents)
+	return intents
+}
+
 /// Remove file entry from the database
 func (orm *SQlite) DeleteEntry(entry *S3NodeTable) {
-	orm.db.Delete(entry.Path)
+	orm.db.Where("Path = ?", entry.Path).Delete(&S3NodeTable{})
+	orm.db.Where("UUID = ?", entry.UUID).Delete(&S3LinkTable{})
+}
+
+/// Forget the names of the path and of its children
+/// Returns the entries of the files that lost their last name
+func (orm *SQlite) DeleteEntries(path string) []S3NodeTable {
+	var removed []S3NodeTable
+	orm.db.Transaction(func(tx *gorm.DB) (err error) {
+		removed, err = forgetNames(tx, path)
+		return err
+	})
+	return removed
+}
+
+/// Move the entries of the path and of its children in one transaction
+/// The names already there belong to the replaced file or directory, they are forgotten
+/// and the entries of the files that lost their last name are returned
+func (orm *SQlite) RenameEntries(oldPath, newPath string) ([]S3NodeTable, error) {
+	var replaced []S3NodeTable
+	err := orm.db.Transaction(func(tx *gorm.DB) (err error) {
+		if replaced, err = forgetNames(tx, newPath); err != nil {
+			return err
+		}
+		return moveEntries(tx, oldPath, newPath)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	orm.accessesMutex.Lock()
+	defer orm.accessesMutex.Unlock()
+	moveAccesses(orm.accesses, oldPath, newPath)
+
+	return replaced, nil
+}
+
+/// Swap the entries of the two paths and of their children in one transaction
+func (orm *SQlite) ExchangeEntries(path1, path2 string) error {
+	// Out of the tree, so that it does not collide with any entry
+	tmpPath := filepath.Join(orm.config.folder, "exchange-"+uuid.New().String())
+
+	err := orm.db.Transaction(func(tx *gorm.DB) error {
+		if err := moveEntries(tx, path1, tmpPath); err != nil {
+			return err
+		}
+		if err := moveEntries(tx, path2, path1); err != nil {
+			return err
+		}
+		return moveEntries(tx, tmpPath, path2)
+	})
+	if err != nil {
+		return err
+	}
+
+	orm.accessesMutex.Lock()
+	defer orm.accessesMutex.Unlock()
+	moveAccesses(orm.accesses, path1, tmpPath)
+	moveAccesses(orm.accesses, path2, path1)
+	moveAccesses(orm.accesses, tmpPath, path2)
+
+	return nil
+}
+
+/// Returns the remote entries of the path and of its children whose object is still keyed by their path
+func (orm *SQlite) GetLegacyEntries(path string) []S3NodeTable {
+	var entries []S3NodeTable
+	whereSubpath(orm.db, path).Where("Server <> ? AND (Object_Key = ? OR Object_Key IS NULL)", "", "").Preload("S3RuleTable").Find(&entries)
+	return entries
+}
+
+/// Select the entry of the path and the ones of its children
+func whereSubpath(db *gorm.DB, path string) *gorm.DB {
+	// SUBSTR counts characters, not bytes
+	prefix := path + "/"
+	return db.Where("Path = ? OR SUBSTR(Path, 1, ?) = ?", path, utf8.RuneCountInString(prefix), prefix)
+}
+
+func moveEntries(tx *gorm.DB, oldPath, newPath string) error {
+	// "||" concatenates the new path with what follows the old one, "" or the path relative to it
+	suffixStart := utf8.RuneCountInString(oldPath) + 1
+	path := gorm.Expr("? || SUBSTR(Path, ?)", newPath, suffixStart)
+
+	if err := whereSubpath(tx.Model(&S3NodeTable{}), oldPath).Update("Path", path).Error; err != nil {
+		return err
+	}
+	return whereSubpath(tx.Model(&S3LinkTable{}), oldPath).Update("Path", path).Error
+}
+
+/// Forget the names of the path and of its children
+/// The entry of a file losing its name takes one of the other names of the file,
+/// the entries of the files that lost their last name are removed and returned
+func forgetNames(tx *gorm.DB, path string) ([]S3NodeTable, error) {
+	if err := whereSubpath(tx, path).Delete(&S3LinkTable{}).Error; err != nil {
+		return nil, err
+	}
+
+	var entries []S3NodeTable
+	if err := whereSubpath(tx, path).Preload("S3RuleTable").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	removed := make([]S3NodeTable, 0)
+	for _, entry := range entries {
+		var links []S3LinkTable
+		if err := tx.Where("UUID = ?", entry.UUID).Limit(1).Find(&links).Error; err != nil {
+			return nil, err
+		}
+
+		if len(links) == 0 {
+			if err := tx.Where("Path = ?", entry.Path).Delete(&S3NodeTable{}).Error; err != nil {
+				return nil, err
+			}
+			removed = append(removed, entry)
+			continue
+		}
+
+		if err := tx.Where("Path = ?", links[0].Path).Delete(&S3LinkTable{}).Error; err != nil {
+			return nil, err
+		}
+		if err := tx.Model(&S3NodeTable{}).Where("Path = ?", entry.Path).Update("Path", links[0].Path).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	return removed, nil
 }
 
-func (orm *SQlite) RenameEntry(oldPath, newPath string) {
-	orm.db.Model(&S3NodeTable{}).Where("Path = ?", oldPath).Update("Path", newPath)
+func moveAccesses(accesses map[string]time.Time, oldPath, newPath string) {
+	moved := make(map[string]time.Time)
+	for path, lastAccess := range accesses {
+		relativePath := ""
+		if IsSubpath(oldPath, path, &relativePath) {
+			delete(accesses, path)
+			moved[filepath.Join(newPath, relativePath)] = lastAccess
+		}
+	}
+
+	for path, lastAccess := range moved {
+		accesses[path] = lastAccess
+	}
 }
 
 /// Tell the DB that the file is local now
-func (orm *SQlite) RetriveFromServer(entry *S3NodeTable) {
-	orm.db.Model(entry).Where("Path = ?", entry.Path).Update("Server", "").Update("Local", true)
+/// The entry is found by UUID, the file may have been renamed during the download
+/// The entry still tracks the remote object when it is kept, so that it is removed with the file
+func (orm *SQlite) RetriveFromServer(entry *S3NodeTable, keepRemote bool) {
+	columns := map[string]interface{}{"Local": true, "Dirty": false}
+	if !keepRemote {
+		columns["Server"] = ""
+		columns["ObjectKey"] = ""
+		columns["PackID"] = ""
+		columns["PackOffset"] = 0
+		columns["PackLength"] = 0
+	}
+	orm.db.Model(&S3NodeTable{}).Where("UUID = ?", entry.UUID).Updates(columns)
+}
+
+/// Record the pack before it is sent
+func (orm *SQlite) CreatePack(pack *S3PackTable) error {
+	return orm.db.Create(pack).Error
+}
+
+/// Record the pack of a rebuilt entry, if it is not already
+func (orm *SQlite) AddIfNotExistsPack(pack *S3PackTable) {
+	orm.db.Where("ID = ?", pack.ID).FirstOrCreate(pack)
+}
+
+func (orm *SQlite) DeletePack(pack *S3PackTable) {
+	orm.db.Where("ID = ?", pack.ID).Delete(&S3PackTable{})
+}
+
+/// Returns the packs of the rule, the oldest first
+func (orm *SQlite) GetPacks(rulePath string) []S3PackTable {
+	var packs []S3PackTable
+	orm.db.Where("S3_Rule_Table_Path = ?", rulePath).Order("Created_At").Find(&packs)
+	return packs
+}
+
+/// Returns the entries whose content is in the pack, the local files keeping their copy included
+func (orm *SQlite) GetPackMembers(pack *S3PackTable) []S3NodeTable {
+	var entries []S3NodeTable
+	orm.db.Where("Pack_ID = ?", pack.ID).Order("Pack_Offset").Find(&entries)
+	return entries
+}
+
+/// Move the content of the entries to the new pack, the entries which left the old pack meanwhile are kept out
+/// The offsets are the ones of the entries in the new pack, by UUID
+func (orm *SQlite) MovePackMembers(from, to *S3PackTable, offsets map[string]int64) error {
+	return orm.db.Transaction(func(tx *gorm.DB) error {
+		for uuid, offset := range offsets {
+			err := tx.Model(&S3NodeTable{}).Where("UUID = ? AND Pack_ID = ?", uuid, from.ID).
+				Updates(map[string]interface{}{"PackID": to.ID, "PackOffset": offset, "ObjectKey": to.ObjectKey, "Server": to.Server}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (orm *SQlite) GetRule(path string) *S3RuleTable {
@@ -144,3 +667,67 @@ func (orm *SQlite) AddOrUpdateRule(path, uuid string) {
 		orm.db.Where("Path = ?", path).Create(&rule)
 	}
 }
+
+func (orm *SQlite) Pin(path string) error {
+	return orm.db.Where("Path = ?", path).FirstOrCreate(&S3PinTable{Path: path}).Error
+}
+
+func (orm *SQlite) Unpin(path string) error {
+	return orm.db.Where("Path = ?", path).Delete(&S3PinTable{}).Error
+}
+
+/// Returns all the pinned paths
+func (orm *SQlite) GetPins() []string {
+	var pins []S3PinTable
+	orm.db.Find(&pins)
+
+	paths := make([]string, len(pins))
+	for i, pin := range pins {
+		paths[i] = pin.Path
+	}
+	return paths
+}
+
+/// Is the path or one of its parents pinned
+func (orm *SQlite) IsPinned(path string) bool {
+	return isPinned(orm.GetPins(), path)
+}
+
+/// Swap the pins of the two paths and of their children
+func (orm *SQlite) ExchangePins(path1, path2 string) {
+	tmpPath := filepath.Join(orm.config.folder, "exchange-"+uuid.New().String())
+	orm.RenamePins(path1, tmpPath)
+	orm.RenamePins(path2, path1)
+	orm.RenamePins(tmpPath, path2)
+}
+
+/// Move the pins of the path and of its children
+func (orm *SQlite) RenamePins(oldPath, newPath string) {
+	for _, pin := range orm.GetPins() {
+		relativePath := ""
+		if IsSubpath(oldPath, pin, &relativePath) {
+			orm.db.Model(&S3PinTable{}).Where("Path = ?", pin).Update("Path", filepath.Join(newPath, relativePath))
+		}
+	}
+}
+
+/// Remove the pins of the path and of its children
+func (orm *SQlite) DeletePins(path string) {
+	for _, pin := range orm.GetPins() {
+		if IsSubpath(path, pin, nil) {
+			orm.Unpin(pin)
+		}
+	}
+}
+
+/// Is one of the paths or one of their parents pinned
+func isPinned(pins []string, paths ...string) bool {
+	for _, pin := range pins {
+		for _, path := range paths {
+			if IsSubpath(pin, path, nil) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// Offload state of a tracked file, its transitions are:
+// Local -> Uploading -> Remote, or back to Local when the upload fails
+// Remote -> Downloading -> Local, or back to Remote when the download fails
+// The stable states are kept in the DB (S3NodeTable.Local), the transient ones only here
+type fileState int
+
+const (
+	LOCAL_STATE fileState = iota
+	UPLOADING_STATE
+	REMOTE_STATE
+	DOWNLOADING_STATE
+)
+
+func (s fileState) String() string {
+	switch s {
+	case UPLOADING_STATE:
+		return "uploading"
+	case REMOTE_STATE:
+		return "remote"
+	case DOWNLOADING_STATE:
+		return "downloading"
+	default:
+		return "local"
+	}
+}
+
+// Returned when the file is in the middle of another transition and the caller does not wait
+var errTransitionRunning = errors.New("Another transition of the file is running")
+
+// A running transition, the callers asking for the same one share its result
+type transition struct {
+	state fileState
+	done  chan struct{}
+	err   error
+}
+
+// Synchronization of one file
+type fileLock struct {
+	// Held for writing by the transitions, for reading by the ranged reads of the remote file
+	rw sync.RWMutex
+
+	transition *transition
+
+	// Goroutines using the lock, it is dropped when the last one is done
+	users int
+}
+
+// Serializes the transitions of the files: one upload or download per file at a time
+// The files are identified by the UUID of their entry, so the names of a file linked
+// more than once, or a file renamed during a transition, share the same state
+type stateMachine struct {
+	mutex sync.Mutex
+	files map[string]*fileLock
+}
+
+func newStateMachine() *stateMachine {
+	return &stateMachine{
+		files: make(map[string]*fileLock),
+	}
+}
+
+/// The state of the file, the transient one when a transition is running
+func (m *stateMachine) State(entry *S3NodeTable) fileState {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if lock, ok := m.files[entry.UUID]; ok && lock.transition != nil {
+		return lock.transition.state
+	}
+
+	if entry.Local {
+		return LOCAL_STATE
+	}
+	return REMOTE_STATE
+}
+
+/// Run the transition of the file to the state
+/// A caller asking for the running transition waits for it and gets its result, so
+/// concurrent recalls of a file download it once. When another transition is running,
+/// the caller waits for it and runs its own afterwards, or returns errTransitionRunning
+/// without wait. run must check that the transition is still needed.
+func (m *stateMachine) Transition(uuid string, state fileState, wait bool, run func() error) error {
+	for {
+		m.mutex.Lock()
+		lock := m.acquire(uuid)
+		current := lock.transition
+
+		if current == nil {
+			current = &transition{state: state, done: make(chan struct{})}
+			lock.transition = current
+			m.mutex.Unlock()
+
+			lock.rw.Lock()
+			current.err = run()
+			lock.rw.Unlock()
+
+			m.mutex.Lock()
+			lock.transition = nil
+			m.release(uuid, lock)
+			m.mutex.Unlock()
+
+			close(current.done)
+			return current.err
+		}
+
+		m.release(uuid, lock)
+		m.mutex.Unlock()
+
+		if current.state != state && !wait {
+			return errTransitionRunning
+		}
+
+		<-current.done
+
+		if current.state == state {
+			return current.err
+		}
+	}
+}
+
+/// Run one transition for several files, the files in the middle of another transition are left out
+/// run gets the UUIDs of the files whose transition it runs, it is run once all of them are held
+func (m *stateMachine) TransitionAll(uuids []string, state fileState, run func(held []string) error) error {
+	held := make([]string, 0, len(uuids))
+
+	var next func(i int) error
+	next = func(i int) error {
+		for ; i < len(uuids); i++ {
+			// The caller joining a running transition to the same state does not run its own
+			ran := false
+			err := m.Transition(uuids[i], state, false, func() error {
+				ran = true
+				held = append(held, uuids[i])
+				return next(i + 1)
+			})
+
+			if ran {
+				return err
+			}
+		}
+		return run(held)
+	}
+
+	return next(0)
+}
+
+/// Run a ranged read of the remote file, the transitions of the file wait for the running reads
+/// read must check that the file is still remote
+func (m *stateMachine) Read(uuid string, read func() error) error {
+	m.mutex.Lock()
+	lock := m.acquire(uuid)
+	m.mutex.Unlock()
+
+	lock.rw.RLock()
+	err := read()
+	lock.rw.RUnlock()
+
+	m.mutex.Lock()
+	m.release(uuid, lock)
+	m.mutex.Unlock()
+
+	return err
+}
+
+// The mutex must be held
+func (m *stateMachine) acquire(uuid string) *fileLock {
+	lock, ok := m.files[uuid]
+	if !ok {
+		lock = &fileLock{}
+		m.files[uuid] = lock
+	}
+
+	lock.users++
+	return lock
+}
+
+// The mutex must be held
+func (m *stateMachine) release(uuid string, lock *fileLock) {
+	lock.users--
+	if lock.users == 0 {
+		delete(m.files, uuid)
+	}
+}
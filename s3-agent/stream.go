@@ -0,0 +1,191 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Size of the blocks fetched from remote by the ranged reads
+const streamBlockSize = 4 << 20
+
+// Share of a streamed file that can be read before the file is fully downloaded
+const defaultHydrateRatio = 0.5
+
+// Bitmap of the blocks cached in the loopback file, kept on the loopback file
+// itself so that a partially cached file is never mistaken for a local one
+// The attribute values are limited to a block on most filesystems, 4Ko on ext4: the files
+// whose bitmap does not fit, beyond 128Go, and the files of loopbacks without user attributes
+// are downloaded instead of streamed
+const cachedBlocksXattr = "user.s3agent.cached_blocks"
+
+// Blocks of a remote file cached in its sparse loopback file
+type blockCache struct {
+	size   int64
+	blocks []byte
+}
+
+func newBlockCache(size int64) *blockCache {
+	nbBlocks := (size + streamBlockSize - 1) / streamBlockSize
+	return &blockCache{size: size, blocks: make([]byte, (nbBlocks+7)/8)}
+}
+
+func (c *blockCache) has(block int64) bool {
+	return c.blocks[block/8]&(1<<(block%8)) != 0
+}
+
+func (c *blockCache) set(block int64) {
+	c.blocks[block/8] |= 1 << (block % 8)
+}
+
+// Number of bytes of the file cached locally
+func (c *blockCache) cachedBytes() int64 {
+	cached := int64(0)
+	for block := int64(0); block*streamBlockSize < c.size; block++ {
+		if c.has(block) {
+			cached += c.blockLength(block)
+		}
+	}
+	return cached
+}
+
+// The last block may be shorter than the others
+func (c *blockCache) blockLength(block int64) int64 {
+	if remaining := c.size - block*streamBlockSize; remaining < streamBlockSize {
+		return remaining
+	}
+	return streamBlockSize
+}
+
+// Returns true if the file has blocks cached by ranged reads
+func hasCachedBlocks(path string) bool {
+	sz, err := unix.Lgetxattr(path, cachedBlocksXattr, nil)
+	return err == nil && sz > 0
+}
+
+/// Returns the block cache of a remote file, loaded from the loopback file the first time
+/// The streams mutex must be held
+func (fs *S3FS) getBlockCache(entry *S3NodeTable) *blockCache {
+	if cache, ok := fs.streams[entry.Path]; ok {
+		return cache
+	}
+
+	cache := newBlockCache(entry.Size)
+	if sz, err := unix.Lgetxattr(entry.Path, cachedBlocksXattr, cache.blocks); err != nil || sz != len(cache.blocks) {
+		// Nothing or an unusable bitmap, the blocks will be fetched again
+		cache = newBlockCache(entry.Size)
+	}
+
+	fs.streams[entry.Path] = cache
+	return cache
+}
+
+/// Forget the cached blocks, the loopback file is about to be replaced
+func (fs *S3FS) dropBlockCache(path string) {
+	fs.streamsMutex.Lock()
+	defer fs.streamsMutex.Unlock()
+
+	delete(fs.streams, path)
+	unix.Lremovexattr(path, cachedBlocksXattr)
+}
+
+/// Forget the blocks cached in memory for the path and its children, they are read
+/// again from the attribute of the loopback files when needed
+func (fs *S3FS) forgetStreams(path string) {
+	fs.streamsMutex.Lock()
+	defer fs.streamsMutex.Unlock()
+
+	for cachePath := range fs.streams {
+		if IsSubpath(path, cachePath, nil) {
+			delete(fs.streams, cachePath)
+		}
+	}
+}
+
+/// Make sure the bytes in [off, off+size) of a remote file are in its loopback file
+/// Fetch the missing blocks with ranged reads, returns true once enough of the file
+/// has been read to download the whole file
+func (fs *S3FS) streamRange(entry *S3NodeTable, off int64, size int) (bool, error) {
+
+	if off >= entry.Size || size <= 0 {
+		return false, nil
+	}
+
+	end := off + int64(size)
+	if end > entry.Size {
+		end = entry.Size
+	}
+
+	file, err := os.OpenFile(entry.Path, os.O_WRONLY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	// The bitmap is written before the first block, the file is never left without it
+	if !hasCachedBlocks(entry.Path) {
+		fs.streamsMutex.Lock()
+		err := unix.Lsetxattr(entry.Path, cachedBlocksXattr, fs.getBlockCache(entry).blocks, 0)
+		fs.streamsMutex.Unlock()
+
+		if err != nil {
+			fs.logger.Printf("Cannot stream %v, downloading it: %v\n", entry.Path, err)
+			fs.dropBlockCache(entry.Path)
+			return true, nil
+		}
+	}
+
+	// The remote file was truncated when sent, give it back its size without allocating it
+	if stat, err := file.Stat(); err == nil && stat.Size() < entry.Size {
+		if err := file.Truncate(entry.Size); err != nil {
+			return false, err
+		}
+	}
+
+	for block := off / streamBlockSize; block*streamBlockSize < end; block++ {
+
+		fs.streamsMutex.Lock()
+		cache := fs.getBlockCache(entry)
+		cached := cache.has(block)
+		fs.streamsMutex.Unlock()
+
+		if cached {
+			continue
+		}
+
+		blockOff := block * streamBlockSize
+		data, err := fs.rclone.ReadRange(entry, blockOff, cache.blockLength(block))
+		if err != nil {
+			return false, err
+		}
+
+		if _, err := file.WriteAt(data, blockOff); err != nil {
+			return false, err
+		}
+
+		fs.streamsMutex.Lock()
+		cache.set(block)
+		err = unix.Lsetxattr(entry.Path, cachedBlocksXattr, cache.blocks, 0)
+		fs.streamsMutex.Unlock()
+
+		// No room left for the attribute, the file goes back to its truncated state
+		if err != nil {
+			fs.logger.Printf("Cannot keep the cached blocks of %v, downloading it: %v\n", entry.Path, err)
+			fs.dropBlockCache(entry.Path)
+			return true, file.Truncate(0)
+		}
+	}
+
+	fs.streamsMutex.Lock()
+	cachedBytes := fs.getBlockCache(entry).cachedBytes()
+	fs.streamsMutex.Unlock()
+
+	return float64(cachedBytes) >= fs.hydrateRatio()*float64(entry.Size), nil
+}
+
+func (fs *S3FS) hydrateRatio() float64 {
+	if fs.rule == nil || fs.rule.HydrateRatio == 0 {
+		return defaultHydrateRatio
+	}
+	return fs.rule.HydrateRatio
+}
@@ -1,7 +1,10 @@
+import errno
+import hashlib
+import os
 import pytest
 import time
 
-from .utils import assert_agent_file, create_file
+from .utils import assert_agent_file, assert_entry_state, assert_rclone_file, assert_remote_entry, create_file, get_node_entry, get_rule_entry, rename_exchange, run_command, FILESYSTEM_PATH, S3_AGENT_PATH
 
 
 @pytest.mark.usefixtures('handle_server')
@@ -67,3 +70,354 @@ class TestS3AgentClassBasic:
         ### THEN ###
         assert_agent_file(handle_agent, first_file_path, first_content)
         assert_agent_file(handle_agent, second_file_path, second_content)
+
+
+    def test_s3ignore_file(self, handle_agent):
+        ### GIVEN ###
+        ignored_file_path = 'ignored_folder/ignored_file.db'
+        file_path = 'ignored_folder/not_ignored_file.txt'
+        content = 'Hello world'
+
+        create_file('ignored_folder/.s3ignore', '*.db\n')
+        create_file(ignored_file_path, content)
+        create_file(file_path, content)
+
+        ### WHEN ###
+        time.sleep(2)
+
+        ### THEN ###
+        assert_remote_entry(handle_agent, ignored_file_path, False)
+        assert_rclone_file('ignored_folder/.s3ignore', False)
+        assert_entry_state(handle_agent, ignored_file_path, 0, 1, '')
+        assert_agent_file(handle_agent, file_path, content)
+
+
+    def test_state_xattrs(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'xattr_file.txt'
+        content = 'Hello world'
+
+        create_file(file_path, content)
+
+        ### WHEN ###
+        time.sleep(2)
+
+        ### THEN ###
+        path = f'{FILESYSTEM_PATH}/{file_path}'
+        assert os.getxattr(path, 'user.s3agent.state') == b'remote'
+        assert os.getxattr(path, 'user.s3agent.server') == b'remote'
+        assert os.getxattr(path, 'user.s3agent.remote_size') == str(len(content)).encode()
+        assert get_node_entry(handle_agent, file_path)['uuid'] in os.getxattr(path, 'user.s3agent.object_key').decode()
+        assert 'user.s3agent.state' in os.listxattr(path)
+
+
+    def test_fetch_action(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'action_folder/action_file.txt'
+        content = 'Hello world'
+
+        create_file(file_path, content)
+        time.sleep(2)
+        assert_remote_entry(handle_agent, file_path)
+
+        ### WHEN ###
+        os.setxattr(f'{FILESYSTEM_PATH}/action_folder', 'user.s3agent.action', b'fetch')
+        time.sleep(1)
+
+        ### THEN ###
+        assert os.getxattr(f'{FILESYSTEM_PATH}/action_folder', 'user.s3agent.action') == b'fetch done 1/1'
+
+
+    def test_rename_remote_file(self, handle_agent):
+        ### GIVEN ###
+        old_file_path = 'renamed_file.txt'
+        new_file_path = 'renamed_folder/renamed_file.txt'
+        content = 'Hello world'
+
+        create_file(old_file_path, content)
+        os.makedirs(f'{FILESYSTEM_PATH}/renamed_folder')
+        time.sleep(2)
+        assert_remote_entry(handle_agent, old_file_path)
+
+        ### WHEN ###
+        os.rename(f'{FILESYSTEM_PATH}/{old_file_path}', f'{FILESYSTEM_PATH}/{new_file_path}')
+
+        ### THEN ###
+        assert_remote_entry(handle_agent, new_file_path)
+        assert_agent_file(handle_agent, new_file_path, content)
+
+
+    def test_rename_nested_folder(self, handle_agent):
+        ### GIVEN ###
+        first_file_path = 'nested_folder/file_1.txt'
+        second_file_path = 'nested_folder/subfolder/subsubfolder/file_2.txt'
+        first_content = 'Hello world first'
+        second_content = 'Hello world second'
+
+        create_file(first_file_path, first_content)
+        create_file(second_file_path, second_content)
+        os.makedirs(f'{FILESYSTEM_PATH}/moved_folder')
+        time.sleep(2)
+
+        ### WHEN ###
+        os.rename(f'{FILESYSTEM_PATH}/nested_folder', f'{FILESYSTEM_PATH}/moved_folder/nested_folder')
+
+        ### THEN ###
+        assert get_node_entry(handle_agent, first_file_path) is None
+        assert get_node_entry(handle_agent, second_file_path) is None
+        assert_agent_file(handle_agent, f'moved_folder/{first_file_path}', first_content)
+        assert_agent_file(handle_agent, f'moved_folder/{second_file_path}', second_content)
+
+
+    def test_rename_replace_remote_file(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'replacing_file.txt'
+        replaced_file_path = 'replaced_folder/replaced_file.txt'
+        content = 'Hello world first'
+        replaced_content = 'Hello world second'
+
+        create_file(file_path, content)
+        create_file(replaced_file_path, replaced_content)
+        time.sleep(2)
+        replaced_uuid = get_node_entry(handle_agent, replaced_file_path)['uuid']
+
+        ### WHEN ###
+        os.rename(f'{FILESYSTEM_PATH}/{file_path}', f'{FILESYSTEM_PATH}/{replaced_file_path}')
+
+        ### THEN ###
+        assert get_node_entry(handle_agent, file_path) is None
+        assert_rclone_file(replaced_uuid, False)
+        assert_agent_file(handle_agent, replaced_file_path, content)
+
+
+    def test_rename_exchange_folders(self, handle_agent):
+        ### GIVEN ###
+        first_file_path = 'exchanged_1/subfolder/file.txt'
+        second_file_path = 'exchanged_2/subfolder/file.txt'
+        first_content = 'Hello world first'
+        second_content = 'Hello world second'
+
+        create_file(first_file_path, first_content)
+        create_file(second_file_path, second_content)
+        time.sleep(2)
+
+        ### WHEN ###
+        rename_exchange('exchanged_1', 'exchanged_2')
+
+        ### THEN ###
+        assert_agent_file(handle_agent, first_file_path, second_content)
+        assert_agent_file(handle_agent, second_file_path, first_content)
+
+
+    def test_rmdir_remove_entries(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'removed_folder/subfolder/file.txt'
+        content = 'Hello world'
+
+        create_file(file_path, content)
+        time.sleep(2)
+        uuid = get_node_entry(handle_agent, file_path)['uuid']
+
+        ### WHEN ###
+        os.remove(f'{FILESYSTEM_PATH}/{file_path}')
+        os.rmdir(f'{FILESYSTEM_PATH}/removed_folder/subfolder')
+        os.rmdir(f'{FILESYSTEM_PATH}/removed_folder')
+
+        ### THEN ###
+        assert get_node_entry(handle_agent, file_path) is None
+        assert_rclone_file(uuid, False)
+
+
+    def test_hardlink_remote_file(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'linked_file.txt'
+        link_path = 'linked_folder/link.txt'
+        content = 'Hello world'
+
+        create_file(file_path, content)
+        os.makedirs(f'{FILESYSTEM_PATH}/linked_folder')
+        os.link(f'{FILESYSTEM_PATH}/{file_path}', f'{FILESYSTEM_PATH}/{link_path}')
+        time.sleep(2)
+        uuid = get_node_entry(handle_agent, file_path)['uuid']
+
+        ### WHEN ###
+        os.remove(f'{FILESYSTEM_PATH}/{file_path}')
+
+        ### THEN ###
+        assert get_node_entry(handle_agent, link_path)['uuid'] == uuid
+        assert_agent_file(handle_agent, link_path, content)
+
+
+    def test_open_file_stays_local(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'open_file.txt'
+        content = 'Hello world'
+
+        with open(f'{FILESYSTEM_PATH}/{file_path}', 'w') as file:
+            file.write(content)
+            file.flush()
+
+            ### WHEN ###
+            time.sleep(3)
+
+            ### THEN ###
+            assert_entry_state(handle_agent, file_path, 0, 1, '')
+
+        time.sleep(3)
+        assert_agent_file(handle_agent, file_path, content)
+
+
+    def test_pin_folder(self, handle_agent):
+        ### GIVEN ###
+        folder_path = 'pinned_folder'
+        file_path = f'{folder_path}/pinned_file.txt'
+        content = 'Hello world'
+
+        os.makedirs(f'{FILESYSTEM_PATH}/{folder_path}')
+        os.setxattr(f'{FILESYSTEM_PATH}/{folder_path}', 'user.s3agent.pinned', b'1')
+
+        ### WHEN ###
+        create_file(file_path, content)
+        time.sleep(3)
+
+        ### THEN ###
+        # The children of a pinned folder stay local
+        assert os.getxattr(f'{FILESYSTEM_PATH}/{folder_path}', 'user.s3agent.pinned') == b'1'
+        assert_remote_entry(handle_agent, file_path, False)
+        assert_entry_state(handle_agent, file_path, 0, 1, '')
+
+        # Sent again by the next cycles once unpinned
+        os.removexattr(f'{FILESYSTEM_PATH}/{folder_path}', 'user.s3agent.pinned')
+        time.sleep(3)
+        assert_agent_file(handle_agent, file_path, content)
+
+
+    def test_pin_remote_file(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'pinned_remote_file.txt'
+        content = 'Hello world'
+
+        create_file(file_path, content)
+        time.sleep(2)
+        assert_remote_entry(handle_agent, file_path)
+
+        ### WHEN ###
+        os.setxattr(f'{FILESYSTEM_PATH}/{file_path}', 'user.s3agent.pinned', b'1')
+        time.sleep(1)
+
+        ### THEN ###
+        # Recalled in the background and kept local
+        assert_entry_state(handle_agent, file_path, len(content), 1, '')
+        time.sleep(3)
+        assert_entry_state(handle_agent, file_path, len(content), 1, '')
+
+        with open(f'{FILESYSTEM_PATH}/{file_path}') as file:
+            assert file.readlines()[0] == content
+
+
+    def test_checksum_stored(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'checksum_file.txt'
+        content = 'Hello world'
+
+        create_file(file_path, content)
+
+        ### WHEN ###
+        time.sleep(2)
+
+        ### THEN ###
+        assert get_node_entry(handle_agent, file_path)['checksum'] == hashlib.md5(content.encode()).hexdigest()
+        assert_agent_file(handle_agent, file_path, content)
+
+
+    def test_recall_replaces_file(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'recalled_file.txt'
+        link_path = 'recalled_link.txt'
+        content = 'Hello world'
+
+        create_file(file_path, content)
+        os.link(f'{FILESYSTEM_PATH}/{file_path}', f'{FILESYSTEM_PATH}/{link_path}')
+        time.sleep(2)
+        assert_remote_entry(handle_agent, file_path)
+
+        ### WHEN ###
+        with open(f'{FILESYSTEM_PATH}/{link_path}') as file:
+            assert file.readlines()[0] == content
+
+        ### THEN ###
+        # The object is removed once the downloaded copy is in place under both names
+        assert os.stat(f'{FILESYSTEM_PATH}/{file_path}').st_nlink == 2
+        assert os.listdir(f'{S3_AGENT_PATH}/staging') == []
+        assert_remote_entry(handle_agent, file_path, False)
+
+
+    def test_truncating_open_skips_download(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'truncated_file.txt'
+        content = 'Hello world'
+        new_content = 'Hello new world'
+
+        create_file(file_path, content)
+        time.sleep(2)
+        assert_remote_entry(handle_agent, file_path)
+
+        # The object is gone, the truncating open must not need it
+        uuid = get_node_entry(handle_agent, file_path)['uuid']
+        rclone_config_path = os.path.join(S3_AGENT_PATH, 'rclone.conf.tmp')
+        rule_uuid = get_rule_entry(handle_agent)['uuid']
+        run_command(f'./rclone --config {rclone_config_path} deletefile remote:bucket-test/s3-agent/{rule_uuid}/objects/{uuid}', code=0)
+
+        ### WHEN ###
+        with open(f'{FILESYSTEM_PATH}/{file_path}', 'w') as file:
+            assert get_node_entry(handle_agent, file_path)['local'] == 1
+            file.write(new_content)
+
+        ### THEN ###
+        time.sleep(2)
+        assert_agent_file(handle_agent, file_path, new_content)
+
+
+@pytest.mark.usefixtures('handle_server')
+@pytest.mark.parametrize('handle_agent', ['tests/data/lazy_config.json'], indirect=True)
+class TestS3AgentClassActions:
+
+
+    def test_offload_action(self, handle_agent):
+        ### GIVEN ###
+        folder_path = 'offload_folder'
+        file_paths = [f'{folder_path}/offload_file_1.txt', f'{folder_path}/offload_file_2.txt']
+        content = 'Hello world'
+
+        for file_path in file_paths:
+            create_file(file_path, content)
+        time.sleep(1)
+        for file_path in file_paths:
+            assert_entry_state(handle_agent, file_path, 0, 1, '')
+
+        ### WHEN ###
+        os.setxattr(f'{FILESYSTEM_PATH}/{folder_path}', 'user.s3agent.action', b'offload')
+        time.sleep(2)
+
+        ### THEN ###
+        assert os.getxattr(f'{FILESYSTEM_PATH}/{folder_path}', 'user.s3agent.action') == b'offload done 2/2'
+        for file_path in file_paths:
+            assert_agent_file(handle_agent, file_path, content)
+
+        # The progress of a finished action is dropped once read
+        with pytest.raises(OSError) as error:
+            os.getxattr(f'{FILESYSTEM_PATH}/{folder_path}', 'user.s3agent.action')
+        assert error.value.errno == errno.ENODATA
+
+
+    def test_invalid_action(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'invalid_action_file.txt'
+        create_file(file_path, 'Hello world')
+
+        ### WHEN ###
+        with pytest.raises(OSError) as error:
+            os.setxattr(f'{FILESYSTEM_PATH}/{file_path}', 'user.s3agent.action', b'shred')
+
+        ### THEN ###
+        assert error.value.errno == errno.EINVAL
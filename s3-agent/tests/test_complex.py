@@ -1,10 +1,13 @@
+import datetime
+import json
 import os
 import pytest
 import sqlite3
 import subprocess
+import tempfile
 import time
 
-from .utils import assert_rclone_file, create_file, assert_agent_file, start_agent, stop_agent, run_command, get_rule_entry, assert_entry_state, S3_AGENT_PATH, FILESYSTEM_PATH
+from .utils import assert_rclone_file, create_file, assert_agent_file, start_agent, stop_agent, rename_exchange, run_command, get_node_entry, get_rule_entry, assert_entry_state, S3_AGENT_PATH, FILESYSTEM_PATH
 
 
 @pytest.mark.usefixtures('handle_server')
@@ -39,6 +42,61 @@ class TestS3AgentClassComplex:
         assert_agent_file(self.connection.cursor(), second_file_path, second_content)
 
 
+    def test_import_packs_small_files(self):
+        ### GIVEN ###
+        file_paths = ['import_packed_file_1.txt', 'folder/import_packed_file_2.txt']
+        content = 'Hello world'
+
+        for file_path in file_paths:
+            create_file(file_path, content)
+
+        ### WHEN ###
+        self.process, self.connection = start_agent('tests/data/pack_config.json', reset_env=False)
+        time.sleep(3)
+
+        ### THEN ###
+        # The imported files are sent together in one pack
+        cursor = self.connection.cursor()
+        cursor.execute("SELECT COUNT(*) FROM s3_pack_tables")
+        assert cursor.fetchone()[0] == 1
+
+        pack_ids = {get_node_entry(self.connection.cursor(), file_path)['pack_id'] for file_path in file_paths}
+        assert len(pack_ids) == 1 and '' not in pack_ids
+
+        for file_path in file_paths:
+            with open(f'{FILESYSTEM_PATH}/{file_path}') as file:
+                assert file.readlines()[0] == content
+
+
+    def test_import_hardlinked_files(self):
+        ### GIVEN ###
+        file_path = 'import_linked_file.txt'
+        link_path = 'folder/import_link.txt'
+        content = 'Hello world linked'
+
+        create_file(file_path, content)
+        os.makedirs(f'{FILESYSTEM_PATH}/folder', exist_ok=True)
+        os.link(f'{FILESYSTEM_PATH}/{file_path}', f'{FILESYSTEM_PATH}/{link_path}')
+
+        ### WHEN ###
+        self.process, self.connection = start_agent('tests/data/simple_config.json', reset_env=False)
+        time.sleep(3)
+
+        ### THEN ###
+        # The second name is a link of the first entry, the file is sent once
+        assert get_node_entry(self.connection.cursor(), link_path) is None
+        uuid = get_node_entry(self.connection.cursor(), file_path)['uuid']
+
+        cursor = self.connection.cursor()
+        cursor.execute("SELECT uuid FROM s3_link_tables WHERE path LIKE ?", (f'%/{link_path}',))
+        assert [row[0] for row in cursor.fetchall()] == [uuid]
+
+        assert os.stat(f'{FILESYSTEM_PATH}/{file_path}').st_nlink == 2
+        assert_agent_file(self.connection.cursor(), file_path, content)
+        with open(f'{FILESYSTEM_PATH}/{link_path}') as file:
+            assert file.readlines()[0] == content
+
+
     def test_import_deep_folder(self):
         ### GIVEN ###
         file_path = 'folder1/folder2/deep_folder_file.txt'
@@ -77,24 +135,566 @@ class TestS3AgentClassComplex:
         assert_agent_file(self.connection.cursor(), second_file_path, second_content)
 
 
-    def test_rebuild_mode(self):
+    def test_crash_recovery(self):
+        ### GIVEN ###
+        self.process, self.connection = start_agent('tests/data/lazy_config.json')
+
+        file_path = 'crash_file.txt'
+        content = 'Hello world'
+
+        # The sender never runs, the entry of the file stays batched
+        create_file(file_path, content)
+
+        ### WHEN ###
+        self.process.kill()
+        self.process.wait()
+        run_command('umount tmp')
+        self.connection.close()
+        self.process, self.connection = start_agent('tests/data/lazy_config.json', reset_env=False)
+
+        ### THEN ###
+        assert_entry_state(self.connection.cursor(), file_path, len(content), 1, '')
+
+        # Only the intent of the running mount is left
+        cursor = self.connection.cursor()
+        cursor.execute("SELECT kind FROM s3_intent_tables")
+        assert cursor.fetchall() == [('mount',)]
+
+
+    def restart_after_crash(self, config_path, file_path, kind, keep_remote=False, checksum=None, size=None):
+        # The transition of the file was interrupted, its intent is left in the journal
+        entry = get_node_entry(self.connection.cursor(), file_path)
+        stop_agent(self.process, reset_env=False)
+        self.connection.execute(
+            "INSERT INTO s3_intent_tables (kind, uuid, path, server, object_key, size, checksum, keep_remote, pack_id, created_at) "
+            "VALUES (?, ?, ?, ?, ?, ?, ?, ?, '', datetime('now'))",
+            (kind, entry['uuid'], entry['path'], 'remote', entry['object_key'],
+             entry['size'] if size is None else size, entry['checksum'] if checksum is None else checksum, keep_remote))
+        self.connection.commit()
+        self.connection.close()
+
+        self.process, self.connection = start_agent(config_path, reset_env=False)
+        return entry
+
+
+    def assert_only_mount_intent(self):
+        cursor = self.connection.cursor()
+        cursor.execute("SELECT kind FROM s3_intent_tables")
+        assert [row[0] for row in cursor.fetchall()] == ['mount']
+
+
+    def test_replay_upload(self):
+        ### GIVEN ###
+        self.process, self.connection = start_agent('tests/data/simple_config.json')
+
+        file_path = 'replay_upload_file.txt'
+        content = 'Hello world'
+
+        create_file(file_path, content)
+        time.sleep(2)
+        entry = get_node_entry(self.connection.cursor(), file_path)
+        assert entry['local'] == 0
+
+        # The crash happened after the entry was updated, before the file was truncated
+        with open(entry['path'], 'w') as file:
+            file.write(content)
+
+        ### WHEN ###
+        self.restart_after_crash('tests/data/simple_config.json', file_path, 'upload')
+
+        ### THEN ###
+        assert os.path.getsize(entry['path']) == 0
+        self.assert_only_mount_intent()
+        assert_agent_file(self.connection.cursor(), file_path, content)
+
+
+    def test_replay_upload_of_changed_file(self):
+        ### GIVEN ###
+        self.process, self.connection = start_agent('tests/data/simple_config.json')
+
+        file_path = 'replay_changed_file.txt'
+        content = 'Hello world'
+        new_content = 'Hello new world'
+
+        create_file(file_path, content)
+        time.sleep(2)
+        entry = get_node_entry(self.connection.cursor(), file_path)
+        assert entry['local'] == 0
+
+        # The file was written after its upload, before it was truncated
+        with open(entry['path'], 'w') as file:
+            file.write(new_content)
+
+        ### WHEN ###
+        self.restart_after_crash('tests/data/lazy_config.json', file_path, 'upload')
+
+        ### THEN ###
+        # The local content wins, the object is removed
+        assert_entry_state(self.connection.cursor(), file_path, len(new_content), 1, '')
+        assert_rclone_file(entry['uuid'], False)
+        self.assert_only_mount_intent()
+
+        with open(f'{FILESYSTEM_PATH}/{file_path}') as file:
+            assert file.readlines()[0] == new_content
+
+
+    def test_replay_download(self):
+        ### GIVEN ###
+        self.process, self.connection = start_agent('tests/data/simple_config.json')
+
+        file_path = 'replay_download_file.txt'
+        content = 'Hello world'
+
+        create_file(file_path, content)
+        time.sleep(2)
+        entry = get_node_entry(self.connection.cursor(), file_path)
+        assert entry['local'] == 0
+
+        # The crash happened after the download was moved in place, before the entry was updated
+        with open(entry['path'], 'w') as file:
+            file.write(content)
+
+        ### WHEN ###
+        self.restart_after_crash('tests/data/lazy_config.json', file_path, 'download')
+
+        ### THEN ###
+        assert_entry_state(self.connection.cursor(), file_path, len(content), 1, '')
+        assert_rclone_file(entry['uuid'], False)
+        self.assert_only_mount_intent()
+
+
+    def test_replay_evict(self):
+        ### GIVEN ###
+        self.process, self.connection = start_agent('tests/data/cache_config.json')
+
+        file_path = 'replay_evict_file.txt'
+        content = 'Hello world'
+
+        create_file(file_path, content)
+        time.sleep(2)
+        with open(f'{FILESYSTEM_PATH}/{file_path}') as file:
+            assert file.readlines()[0] == content
+        entry = get_node_entry(self.connection.cursor(), file_path)
+        assert entry['local'] == 1
+
+        # The crash happened after the entry of the clean file was marked remote, before it was truncated
+        self.connection.execute("UPDATE s3_node_tables SET local = 0 WHERE uuid = ?", (entry['uuid'],))
+        self.connection.commit()
+
+        ### WHEN ###
+        self.restart_after_crash('tests/data/lazy_config.json', file_path, 'evict')
+
+        ### THEN ###
+        assert os.path.getsize(entry['path']) == 0
+        assert_entry_state(self.connection.cursor(), file_path, len(content), 0, 'remote')
+        self.assert_only_mount_intent()
+
+        with open(f'{FILESYSTEM_PATH}/{file_path}') as file:
+            assert file.readlines()[0] == content
+
+
+    def test_closed_upload_window(self):
+        ### GIVEN ###
+        now = datetime.datetime.now()
+        with open('tests/data/simple_config.json') as file:
+            config = json.load(file)
+
+        config['rules'][0]['upload'] = {'windows': [{
+            'start': (now + datetime.timedelta(hours=2)).strftime('%H:%M'),
+            'end': (now + datetime.timedelta(hours=3)).strftime('%H:%M'),
+        }]}
+
+        config_file = tempfile.NamedTemporaryFile('w', suffix='.json')
+        json.dump(config, config_file)
+        config_file.flush()
+
+        self.process, self.connection = start_agent(config_file.name)
+
+        file_path = 'window_file.txt'
+        content = 'Hello world'
+
+        ### WHEN ###
+        create_file(file_path, content)
+        time.sleep(3)
+
+        ### THEN ###
+        assert_entry_state(self.connection.cursor(), file_path, len(content), 1, '')
+        config_file.close()
+
+
+    def wait_remote_files(self, count, timeout):
+        # Seconds until count files are remote, None if they are not in time
+        start = time.time()
+        cursor = self.connection.cursor()
+        while time.time() - start < timeout:
+            cursor.execute("SELECT COUNT(*) FROM s3_node_tables WHERE local = 0")
+            if cursor.fetchone()[0] >= count:
+                return time.time() - start
+            time.sleep(0.1)
+        return None
+
+
+    def test_rule_bandwidth_single_upload(self):
+        ### GIVEN ###
+        with open('tests/data/simple_config.json') as file:
+            config = json.load(file)
+
+        config['rules'][0]['upload'] = {'concurrency': 4, 'bandwidth': '100Ko'}
+
+        config_file = tempfile.NamedTemporaryFile('w', suffix='.json')
+        json.dump(config, config_file)
+        config_file.flush()
+
+        self.process, self.connection = start_agent(config_file.name)
+
+        file_path = 'bandwidth_file.txt'
+        content = 'a' * 300_000
+
+        ### WHEN ###
+        create_file(file_path, content)
+        elapsed = self.wait_remote_files(1, 10)
+
+        ### THEN ###
+        # The only upload gets the whole cap of the rule, not a quarter of it
+        assert elapsed is not None and 2 < elapsed < 8, elapsed
+        assert_agent_file(self.connection.cursor(), file_path, content)
+        config_file.close()
+
+
+    def test_global_bandwidth_shared(self):
+        ### GIVEN ###
+        with open('tests/data/multi_config.json') as file:
+            config = json.load(file)
+
+        config['bandwidth'] = '100Ko'
+
+        config_file = tempfile.NamedTemporaryFile('w', suffix='.json')
+        json.dump(config, config_file)
+        config_file.flush()
+
+        self.process, self.connection = start_agent(config_file.name)
+
+        second_mountpoint = './tmp2'
+        nb_try = 0
+        while not os.path.exists(second_mountpoint) and nb_try < 20:
+            time.sleep(0.1)
+            nb_try += 1
+
+        file_path = 'global_bandwidth_file.txt'
+        content = 'a' * 200_000
+
+        ### WHEN ###
+        create_file(file_path, content)
+        with open(os.path.join(second_mountpoint, file_path), 'w') as file:
+            file.write(content)
+        elapsed = self.wait_remote_files(2, 14)
+
+        ### THEN ###
+        # The two uploads share the global cap, the idle workers of the rules do not reserve any
+        assert elapsed is not None and 3 < elapsed < 10, elapsed
+        config_file.close()
+
+
+    def test_upload_paused_between_windows(self):
+        ### GIVEN ###
+        # The windows are set to the minute, the upload starts early in the first one
+        now = datetime.datetime.now()
+        if now.second > 30:
+            time.sleep(60 - now.second)
+            now = datetime.datetime.now()
+
+        minute = now.replace(second=0, microsecond=0)
+        with open('tests/data/simple_config.json') as file:
+            config = json.load(file)
+
+        config['rules'][0]['upload'] = {'bandwidth': '20Ko', 'windows': [
+            {'start': minute.strftime('%H:%M'), 'end': (minute + datetime.timedelta(minutes=1)).strftime('%H:%M')},
+            {'start': (minute + datetime.timedelta(minutes=2)).strftime('%H:%M'), 'end': (minute + datetime.timedelta(minutes=4)).strftime('%H:%M')},
+        ]}
+
+        config_file = tempfile.NamedTemporaryFile('w', suffix='.json')
+        json.dump(config, config_file)
+        config_file.flush()
+
+        self.process, self.connection = start_agent(config_file.name)
+
+        # Longer than what is left of the first window
+        file_path = 'paused_file.txt'
+        content = 'a' * ((60 - now.second + 60) * 20 * 1024)
+
+        ### WHEN ###
+        create_file(file_path, content)
+        time.sleep((minute + datetime.timedelta(minutes=1, seconds=30) - datetime.datetime.now()).total_seconds())
+
+        ### THEN ###
+        # The upload is stopped until the next window
+        assert_entry_state(self.connection.cursor(), file_path, len(content), 1, '')
+        assert 'T' in self.upload_states()
+
+        assert self.wait_remote_files(1, 150) is not None
+        assert self.upload_states() == []
+        assert_agent_file(self.connection.cursor(), file_path, content)
+        config_file.close()
+
+
+    def test_upload_cancelled_after_max_pause(self):
+        ### GIVEN ###
+        now = datetime.datetime.now()
+        if now.second > 30:
+            time.sleep(60 - now.second)
+            now = datetime.datetime.now()
+
+        minute = now.replace(second=0, microsecond=0)
+        with open('tests/data/simple_config.json') as file:
+            config = json.load(file)
+
+        config['rules'][0]['upload'] = {'bandwidth': '20Ko', 'max-pause': '10s', 'windows': [
+            {'start': minute.strftime('%H:%M'), 'end': (minute + datetime.timedelta(minutes=1)).strftime('%H:%M')},
+            {'start': (minute + datetime.timedelta(minutes=2)).strftime('%H:%M'), 'end': (minute + datetime.timedelta(minutes=6)).strftime('%H:%M')},
+        ]}
+
+        config_file = tempfile.NamedTemporaryFile('w', suffix='.json')
+        json.dump(config, config_file)
+        config_file.flush()
+
+        self.process, self.connection = start_agent(config_file.name)
+
+        file_path = 'cancelled_file.txt'
+        content = 'a' * ((60 - now.second + 60) * 20 * 1024)
+
+        ### WHEN ###
+        create_file(file_path, content)
+        time.sleep((minute + datetime.timedelta(minutes=1, seconds=45) - datetime.datetime.now()).total_seconds())
+
+        ### THEN ###
+        # The upload was stopped then cancelled, the file stays local until the next window
+        assert_entry_state(self.connection.cursor(), file_path, len(content), 1, '')
+        assert self.upload_states() == []
+
+        assert self.wait_remote_files(1, 270) is not None
+        assert_agent_file(self.connection.cursor(), file_path, content)
+        config_file.close()
+
+
+    def upload_states(self):
+        # The states of the rclone uploads running, 'T' when stopped
+        states = []
+        for pid in filter(str.isdigit, os.listdir('/proc')):
+            try:
+                with open(f'/proc/{pid}/cmdline', 'rb') as file:
+                    if b'copyto' not in file.read().split(b'\0'):
+                        continue
+                with open(f'/proc/{pid}/stat') as file:
+                    states.append(file.read().rsplit(')', 1)[1].split()[0])
+            except OSError:
+                continue
+        return states
+
+
+    def test_quarantine_failed_upload(self):
+        ### GIVEN ###
+        with open('tests/data/simple_config.json') as file:
+            config = json.load(file)
+
+        # The uploads fail: the bucket does not exist and rclone must not create it
+        config['rclone-config']['remote']['bucket'] = 'missing-bucket'
+        config['rclone-config']['remote']['no_check_bucket'] = 'true'
+        config['rules'][0]['retry'] = {'max-attempts': 2, 'backoff': '1s'}
+
+        config_file = tempfile.NamedTemporaryFile('w', suffix='.json')
+        json.dump(config, config_file)
+        config_file.flush()
+
+        self.process, self.connection = start_agent(config_file.name)
+
+        file_path = 'quarantine_file.txt'
+        content = 'Hello world'
+
+        ### WHEN ###
+        create_file(file_path, content)
+        time.sleep(10)
+
+        ### THEN ###
+        assert_entry_state(self.connection.cursor(), file_path, len(content), 1, '')
+
+        cursor = self.connection.cursor()
+        cursor.execute("SELECT kind, attempts, quarantined FROM s3_failure_tables")
+        assert cursor.fetchall() == [('upload', 2, 1)]
+
+        run_command(f'./s3-agent --config-folder={S3_AGENT_PATH} status', stdout='QUARANTINED upload', code=0)
+        run_command(f'./s3-agent --config-folder={S3_AGENT_PATH} status', stdout=file_path, code=0)
+        config_file.close()
+
+
+    def test_failed_download_not_scheduled(self):
         ### GIVEN ###
         self.process, self.connection = start_agent('tests/data/simple_config.json')
 
+        file_path = 'failed_download_file.txt'
+        content = 'Hello world'
+
+        create_file(file_path, content)
+        time.sleep(2)
+        entry = get_node_entry(self.connection.cursor(), file_path)
+        assert entry['local'] == 0
+
+        # The object is gone, the recalls fail
+        rclone_config_path = os.path.join(S3_AGENT_PATH, 'rclone.conf.tmp')
+        rule_uuid = get_rule_entry(self.connection.cursor())['uuid']
+        run_command(f'./rclone --config {rclone_config_path} deletefile remote:bucket-test/s3-agent/{rule_uuid}/objects/{entry["uuid"]}', code=0)
+
+        ### WHEN ###
+        for _ in range(2):
+            with pytest.raises(OSError):
+                with open(f'{FILESYSTEM_PATH}/{file_path}') as file:
+                    file.read()
+
+        ### THEN ###
+        # The reads try again, the recall has no retry schedule
+        cursor = self.connection.cursor()
+        cursor.execute("SELECT kind, attempts, quarantined FROM s3_failure_tables")
+        assert cursor.fetchall() == [('download', 2, 0)]
+
+        run_command(f'./s3-agent --config-folder={S3_AGENT_PATH} status', stdout='FAILING download', code=0)
+        run_command(f'./s3-agent --config-folder={S3_AGENT_PATH} status', stdout='RETRYING', code=0, presence=False)
+
+
+    def test_scheduled_offload(self):
+        ### GIVEN ###
+        with open('tests/data/simple_config.json') as file:
+            config = json.load(file)
+
+        # The cron never runs, the scheduler sends the file once it is old enough
+        config['rules'][0]['params'] = '2s'
+        config['rules'][0]['cron-sender'] = '@every 1h'
+
+        config_file = tempfile.NamedTemporaryFile('w', suffix='.json')
+        json.dump(config, config_file)
+        config_file.flush()
+
+        self.process, self.connection = start_agent(config_file.name)
+
+        file_path = 'scheduled_file.txt'
+        content = 'Hello world'
+
+        ### WHEN ###
+        create_file(file_path, content)
+        time.sleep(1)
+
+        ### THEN ###
+        cursor = self.connection.cursor()
+        cursor.execute("SELECT COUNT(*) FROM s3_node_tables WHERE local = 0")
+        assert cursor.fetchone()[0] == 0
+
+        time.sleep(3)
+        assert_agent_file(self.connection.cursor(), file_path, content)
+        config_file.close()
+
+
+    def start_scheduler_agent(self):
+        # The cron never runs, the scheduler sends the files 3s after their last change
+        with open('tests/data/simple_config.json') as file:
+            config = json.load(file)
+
+        config['rules'][0]['params'] = '3s'
+        config['rules'][0]['cron-sender'] = '@every 1h'
+
+        config_file = tempfile.NamedTemporaryFile('w', suffix='.json')
+        json.dump(config, config_file)
+        config_file.flush()
+
+        self.process, self.connection = start_agent(config_file.name)
+        return config_file
+
+
+    def test_scheduled_offload_renamed(self):
+        ### GIVEN ###
+        config_file = self.start_scheduler_agent()
+
+        content = 'Hello world'
+        create_file('scheduled_folder/renamed_file.txt', content)
+        time.sleep(1)
+
+        ### WHEN ###
+        os.rename(f'{FILESYSTEM_PATH}/scheduled_folder', f'{FILESYSTEM_PATH}/scheduled_renamed_folder')
+
+        ### THEN ###
+        # The queued file moved with its folder and kept its due time
+        time.sleep(1)
+        rule_uuid = get_rule_entry(self.connection.cursor())['uuid']
+        assert os.path.getsize(os.path.join(S3_AGENT_PATH, rule_uuid, 'scheduled_renamed_folder/renamed_file.txt')) == len(content)
+
+        time.sleep(2.5)
+        assert_agent_file(self.connection.cursor(), 'scheduled_renamed_folder/renamed_file.txt', content)
+        assert get_node_entry(self.connection.cursor(), 'scheduled_folder/renamed_file.txt') is None
+        config_file.close()
+
+
+    def test_scheduled_offload_exchanged(self):
+        ### GIVEN ###
+        config_file = self.start_scheduler_agent()
+
+        first_path, second_path = 'exchanged_file_1.txt', 'exchanged_file_2.txt'
+        first_content, second_content = 'Hello world first', 'Hello world second'
+
+        create_file(first_path, first_content)
+        time.sleep(2)
+        create_file(second_path, second_content)
+
+        ### WHEN ###
+        rename_exchange(first_path, second_path)
+
+        ### THEN ###
+        # Each queued file follows its content, the older one is due first
+        time.sleep(2)
+        assert os.getxattr(f'{FILESYSTEM_PATH}/{second_path}', 'user.s3agent.state') == b'remote'
+        assert os.getxattr(f'{FILESYSTEM_PATH}/{first_path}', 'user.s3agent.state') == b'local'
+
+        time.sleep(2.5)
+        assert_agent_file(self.connection.cursor(), second_path, first_content)
+        assert_agent_file(self.connection.cursor(), first_path, second_content)
+        config_file.close()
+
+
+    def test_scheduled_offload_forgotten(self):
+        ### GIVEN ###
+        config_file = self.start_scheduler_agent()
+
+        file_path = 'forgotten_file.txt'
+        create_file(file_path, 'Hello world')
+        time.sleep(1)
+
+        ### WHEN ###
+        os.remove(f'{FILESYSTEM_PATH}/{file_path}')
+        time.sleep(3)
+
+        ### THEN ###
+        # Nothing is sent once the removed file is due, its batched entry is not even flushed
+        cursor = self.connection.cursor()
+        cursor.execute("SELECT COUNT(*) FROM s3_node_tables")
+        assert cursor.fetchone()[0] == 0
+        config_file.close()
+
+
+    def test_rebuild_mode(self):
+        ### GIVEN ###
+        self.process, self.connection = start_agent('tests/data/slow_config.json')
+
         first_file_path = 'rebuild_file_1.txt'
         second_file_path = 'folder/rebuild_file_2.txt'
         first_content = 'Hello world first'
         second_content = 'Hello world second'
 
+        # The second file is not old enough to be sent when the agent stops
         create_file(first_file_path, first_content)
-        time.sleep(2)
+        time.sleep(5)
         create_file(second_file_path, second_content)
 
         ### WHEN ###
         stop_agent(self.process, reset_env=False)
 
         ### THEN ###
-        rule_uuid = get_rule_entry(self.connection.cursor())[0]
+        rule_uuid = get_rule_entry(self.connection.cursor())['uuid']
         assert_entry_state(self.connection.cursor(), first_file_path, len(first_content), 0, 'remote')
         assert_entry_state(self.connection.cursor(), second_file_path, 0, 1, '')
 
@@ -110,6 +710,168 @@ class TestS3AgentClassComplex:
         assert_entry_state(self.connection.cursor(), second_file_path, len(second_content), 1, '')
 
 
+    def test_pins_rebuild_and_fsck(self):
+        ### GIVEN ###
+        self.process, self.connection = start_agent('tests/data/simple_config.json')
+
+        folder_path = 'pinned_folder'
+        file_path = f'{folder_path}/pinned_file.txt'
+        content = 'Hello world'
+
+        os.makedirs(f'{FILESYSTEM_PATH}/{folder_path}')
+        os.setxattr(f'{FILESYSTEM_PATH}/{folder_path}', 'user.s3agent.pinned', b'1')
+        create_file(file_path, content)
+        time.sleep(3)
+
+        stop_agent(self.process, reset_env=False)
+        rule_uuid = get_rule_entry(self.connection.cursor())['uuid']
+        pin_query = f"SELECT COUNT(*) FROM s3_pin_tables WHERE path LIKE '%/{folder_path}'"
+
+        def count_pins():
+            cursor = self.connection.cursor()
+            cursor.execute(pin_query)
+            return cursor.fetchone()[0]
+
+        assert count_pins() == 1
+
+        ### WHEN ###
+        # The DB lost the pin of the folder and holds one the loopback does not
+        self.connection.execute("DELETE FROM s3_pin_tables")
+        self.connection.execute(f"INSERT INTO s3_pin_tables (path) VALUES ('{S3_AGENT_PATH[2:]}/{rule_uuid}/stale_pin')")
+        self.connection.commit()
+        run_command(f'./s3-agent --config-folder={S3_AGENT_PATH} fsck', code=0)
+
+        ### THEN ###
+        assert count_pins() == 1
+        cursor = self.connection.cursor()
+        cursor.execute("SELECT COUNT(*) FROM s3_pin_tables")
+        assert cursor.fetchone()[0] == 1
+
+        ### WHEN ###
+        self.connection.close()
+        run_command(f'rm {os.path.join(S3_AGENT_PATH, "sqlite.db")}', code=0)
+        run_command(f'./s3-agent --config-folder={S3_AGENT_PATH} rebuild {rule_uuid} 0', code=0)
+
+        ### THEN ###
+        self.connection = sqlite3.connect(os.path.join(S3_AGENT_PATH, 'sqlite.db'))
+        assert count_pins() == 1
+        assert_entry_state(self.connection.cursor(), file_path, len(content), 1, '')
+
+
+    def test_repack_rewrites_pack(self):
+        ### GIVEN ###
+        self.process, self.connection = start_agent('tests/data/pack_config.json')
+
+        file_paths = ['repacked_file_1.txt', 'repacked_file_2.txt', 'repacked_file_3.txt']
+        contents = ['Hello world first', 'Hello world second', 'Hello world third']
+        for file_path, content in zip(file_paths, contents):
+            create_file(file_path, content)
+        time.sleep(3)
+
+        cursor = self.connection.cursor()
+        cursor.execute("SELECT id FROM s3_pack_tables")
+        old_pack_id = cursor.fetchone()[0]
+
+        # Two thirds of the pack are garbage
+        for file_path in file_paths[:2]:
+            os.remove(f'{FILESYSTEM_PATH}/{file_path}')
+
+        ### WHEN ###
+        # The repack races with the agent, it must be stopped first
+        run_command(f'./s3-agent --config-folder={S3_AGENT_PATH} repack', stderr='stop it before repacking', code=1)
+
+        stop_agent(self.process, reset_env=False)
+        run_command(f'./s3-agent --config-folder={S3_AGENT_PATH} repack', code=0)
+
+        ### THEN ###
+        # The new pack only holds the remaining file, at its start
+        cursor = self.connection.cursor()
+        cursor.execute("SELECT id, size FROM s3_pack_tables")
+        packs = cursor.fetchall()
+        assert len(packs) == 1
+        new_pack_id, new_pack_size = packs[0]
+        assert new_pack_id != old_pack_id and new_pack_size == len(contents[2])
+
+        entry = get_node_entry(self.connection.cursor(), file_paths[2])
+        assert (entry['pack_id'], entry['pack_offset'], entry['pack_length']) == (new_pack_id, 0, len(contents[2]))
+        assert os.getxattr(entry['path'], 'user.s3agent.pack') == f'{new_pack_id}:0:{len(contents[2])}'.encode()
+
+        assert_rclone_file(new_pack_id)
+        assert_rclone_file(old_pack_id, False)
+
+        self.connection.close()
+        self.process, self.connection = start_agent('tests/data/pack_config.json', reset_env=False)
+        with open(f'{FILESYSTEM_PATH}/{file_paths[2]}') as file:
+            assert file.readlines()[0] == contents[2]
+
+
+    def test_repack_removes_empty_pack(self):
+        ### GIVEN ###
+        self.process, self.connection = start_agent('tests/data/pack_config.json')
+
+        file_paths = ['emptied_file_1.txt', 'emptied_file_2.txt']
+        for file_path in file_paths:
+            create_file(file_path, 'Hello world')
+        time.sleep(3)
+
+        cursor = self.connection.cursor()
+        cursor.execute("SELECT id FROM s3_pack_tables")
+        pack_id = cursor.fetchone()[0]
+
+        for file_path in file_paths:
+            os.remove(f'{FILESYSTEM_PATH}/{file_path}')
+
+        ### WHEN ###
+        stop_agent(self.process, reset_env=False)
+        run_command(f'./s3-agent --config-folder={S3_AGENT_PATH} repack', code=0)
+
+        ### THEN ###
+        cursor = self.connection.cursor()
+        cursor.execute("SELECT COUNT(*) FROM s3_pack_tables")
+        assert cursor.fetchone()[0] == 0
+        assert_rclone_file(pack_id, False)
+
+
+    def test_streamed_read_of_packed_file(self):
+        ### GIVEN ###
+        with open('tests/data/stream_config.json') as file:
+            config = json.load(file)
+
+        config['rules'][0]['pack'] = {'max-file-size': '16Mo'}
+
+        config_file = tempfile.NamedTemporaryFile('w', suffix='.json')
+        json.dump(config, config_file)
+        config_file.flush()
+
+        self.process, self.connection = start_agent(config_file.name)
+
+        # The second file starts 12Mo into the pack, the first one would be read without the offset
+        first_path, second_path = 'streamed_pack_1.bin', 'streamed_pack_2.bin'
+        size = 12 << 20
+        second_content = bytes(i % 251 for i in range(size))
+        with open(f'{FILESYSTEM_PATH}/{first_path}', 'wb') as file:
+            file.write(b'a' * size)
+        with open(f'{FILESYSTEM_PATH}/{second_path}', 'wb') as file:
+            file.write(second_content)
+        time.sleep(6)
+
+        entry = get_node_entry(self.connection.cursor(), second_path)
+        assert entry['local'] == 0 and entry['pack_id'] != ''
+        assert entry['pack_offset'] == size
+
+        ### WHEN ###
+        offset = 5 << 20
+        with open(f'{FILESYSTEM_PATH}/{second_path}', 'rb') as file:
+            file.seek(offset)
+            data = file.read(100)
+
+        ### THEN ###
+        # Only the block of the range was fetched, from the range of the file in the pack
+        assert data == second_content[offset:offset + 100]
+        assert get_node_entry(self.connection.cursor(), second_path)['local'] == 0
+        config_file.close()
+
+
     def test_dry_run_mode(self):
         ### GIVEN ###
         config_path = 'tests/data/slow_config.json'
@@ -138,3 +900,33 @@ class TestS3AgentClassComplex:
 
         assert_rclone_file(first_file_path, False)
         assert_rclone_file(second_file_path)
+
+
+    def test_multiple_rules(self):
+        ### GIVEN ###
+        self.process, self.connection = start_agent('tests/data/multi_config.json')
+
+        second_mountpoint = './tmp2'
+        nb_try = 0
+        while not os.path.exists(second_mountpoint) and nb_try < 20:
+            time.sleep(0.1)
+            nb_try += 1
+
+        first_file_path = 'multi_rule_file_1.txt'
+        second_file_path = 'multi_rule_file_2.txt'
+        first_content = 'Hello world first'
+        second_content = 'Hello world second'
+
+        ### WHEN ###
+        create_file(first_file_path, first_content)
+        with open(os.path.join(second_mountpoint, second_file_path), 'w') as file:
+            file.write(second_content)
+
+        time.sleep(3)
+
+        ### THEN ###
+        assert_agent_file(self.connection.cursor(), first_file_path, first_content)
+        assert os.getxattr(os.path.join(second_mountpoint, second_file_path), 'user.s3agent.state') == b'remote'
+
+        with open(os.path.join(second_mountpoint, second_file_path)) as file:
+            assert file.readlines()[0] == second_content
@@ -0,0 +1,114 @@
+import os
+import pytest
+import time
+
+from concurrent.futures import ThreadPoolExecutor
+
+from .utils import assert_agent_file, assert_entry_state, assert_remote_entry, create_file, FILESYSTEM_PATH
+
+
+NB_THREADS = 8
+
+
+def read_file(file_path, offset=0, size=-1):
+    with open(f'{FILESYSTEM_PATH}/{file_path}', 'rb') as file:
+        file.seek(offset)
+        return file.read(size)
+
+
+@pytest.mark.usefixtures('handle_server')
+@pytest.mark.parametrize('handle_agent', ['tests/data/simple_config.json'], indirect=True)
+class TestS3AgentClassConcurrency:
+
+
+    def test_concurrent_recalls(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'concurrent_file.bin'
+        content = os.urandom(8 * 1024 * 1024)
+
+        with open(f'{FILESYSTEM_PATH}/{file_path}', 'wb') as file:
+            file.write(content)
+
+        time.sleep(3)
+        assert_remote_entry(handle_agent, file_path)
+
+        ### WHEN ###
+        with ThreadPoolExecutor(NB_THREADS) as executor:
+            results = list(executor.map(lambda _: read_file(file_path), range(NB_THREADS)))
+
+        ### THEN ###
+        assert all(result == content for result in results)
+        assert_entry_state(handle_agent, file_path, len(content), 1, '')
+
+
+    def test_opens_during_recall(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'concurrent_opened_file.bin'
+        content = os.urandom(32 * 1024 * 1024)
+
+        with open(f'{FILESYSTEM_PATH}/{file_path}', 'wb') as file:
+            file.write(content)
+
+        time.sleep(3)
+        assert_remote_entry(handle_agent, file_path)
+
+        ### WHEN ###
+        # The handles are opened while the first read recalls the file and replaces it
+        def open_and_read(i):
+            time.sleep(0.05 * i)
+            return read_file(file_path)
+
+        with ThreadPoolExecutor(NB_THREADS) as executor:
+            results = list(executor.map(open_and_read, range(NB_THREADS)))
+
+        ### THEN ###
+        assert all(result == content for result in results)
+        assert_entry_state(handle_agent, file_path, len(content), 1, '')
+
+
+    def test_creations_during_cycles(self, handle_agent):
+        ### GIVEN ###
+        file_paths = [f'concurrent_folder_{i % 2}/file_{i}.txt' for i in range(4 * NB_THREADS)]
+
+        ### WHEN ###
+        # The files are registered while the sender flushes and sends the previous ones
+        def create(file_path):
+            create_file(file_path, file_path)
+            time.sleep(0.1)
+
+        with ThreadPoolExecutor(NB_THREADS) as executor:
+            list(executor.map(create, file_paths))
+
+        time.sleep(3)
+
+        ### THEN ###
+        for file_path in file_paths:
+            assert_agent_file(handle_agent, file_path, file_path)
+
+
+@pytest.mark.usefixtures('handle_server')
+@pytest.mark.parametrize('handle_agent', ['tests/data/stream_config.json'], indirect=True)
+class TestS3AgentClassConcurrentStreams:
+
+
+    def test_concurrent_ranged_reads(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'concurrent_streamed_file.bin'
+        content = os.urandom(20 * 1024 * 1024)
+        block_size = 4 * 1024 * 1024
+
+        with open(f'{FILESYSTEM_PATH}/{file_path}', 'wb') as file:
+            file.write(content)
+
+        time.sleep(3)
+        assert_remote_entry(handle_agent, file_path)
+
+        ### WHEN ###
+        # Reading most of the file hydrates it while the other ranges are still read
+        offsets = [i * block_size for i in range(len(content) // block_size)] * 2
+        with ThreadPoolExecutor(NB_THREADS) as executor:
+            results = list(executor.map(lambda offset: (offset, read_file(file_path, offset, 1024)), offsets))
+
+        ### THEN ###
+        assert all(data == content[offset:offset + 1024] for offset, data in results)
+        assert read_file(file_path) == content
@@ -0,0 +1,408 @@
+import json
+import os
+import pwd
+import pytest
+import time
+
+from .utils import assert_agent_file, assert_entry_state, assert_rclone_file, assert_remote_entry, create_file, get_node_entry, run_command, S3_AGENT_PATH, FILESYSTEM_PATH
+
+
+@pytest.mark.usefixtures('handle_server')
+@pytest.mark.parametrize('handle_agent', ['tests/data/size_config.json'], indirect=True)
+class TestS3AgentClassSizeRules:
+
+
+    def test_larger_than(self, handle_agent):
+        ### GIVEN ###
+        small_file_path = 'small_file.txt'
+        large_file_path = 'large_file.txt'
+        small_content = 'Hello world'
+        large_content = 'Hello world' * 200
+
+        create_file(small_file_path, small_content)
+        create_file(large_file_path, large_content)
+
+        ### WHEN ###
+        time.sleep(2)
+
+        ### THEN ###
+        assert_remote_entry(handle_agent, small_file_path, False)
+        assert_entry_state(handle_agent, small_file_path, 0, 1, '')
+        assert_agent_file(handle_agent, large_file_path, large_content)
+
+
+    def test_size_overflow_rejected(self, handle_agent):
+        ### GIVEN ###
+        config_path = os.path.join(S3_AGENT_PATH, 'overflow_config.json')
+        with open('tests/data/size_config.json') as file:
+            config = json.load(file)
+        config['rules'][0]['params'] = '9999999999To'
+        with open(config_path, 'w') as file:
+            json.dump(config, file)
+
+        ### WHEN ###
+        ### THEN ###
+        run_command(f'./s3-agent --config-folder={S3_AGENT_PATH} config import {config_path}', stderr='Size is too large', code=1)
+
+
+@pytest.mark.usefixtures('handle_server')
+@pytest.mark.parametrize('handle_agent', ['tests/data/smaller_config.json'], indirect=True)
+class TestS3AgentClassSmallerRules:
+
+
+    def test_smaller_than(self, handle_agent):
+        ### GIVEN ###
+        small_file_path = 'small_file.txt'
+        large_file_path = 'large_file.txt'
+        small_content = 'Hello world'
+        large_content = 'Hello world' * 200
+
+        create_file(small_file_path, small_content)
+        create_file(large_file_path, large_content)
+
+        ### WHEN ###
+        time.sleep(2)
+
+        ### THEN ###
+        assert_remote_entry(handle_agent, large_file_path, False)
+        assert_entry_state(handle_agent, large_file_path, 0, 1, '')
+        assert_agent_file(handle_agent, small_file_path, small_content)
+
+
+@pytest.mark.usefixtures('handle_server')
+@pytest.mark.parametrize('handle_agent', ['tests/data/patterns_config.json'], indirect=True)
+class TestS3AgentClassPatterns:
+
+
+    def test_include_exclude_patterns(self, handle_agent):
+        ### GIVEN ###
+        content = 'Hello world'
+        sent_paths = [
+            'logs/app.log',
+            'logs/important.tmp',   # re-included by the negated exclude pattern
+        ]
+        local_paths = [
+            'other.txt',            # not included
+            'logs/debug.log',       # re-excluded by the negated include pattern
+            'logs/cache.tmp',       # the exclude patterns win over the include ones
+            'logs/secret/app.log',  # under an excluded directory
+        ]
+
+        ### WHEN ###
+        for file_path in sent_paths + local_paths:
+            create_file(file_path, content)
+        time.sleep(3)
+
+        ### THEN ###
+        for file_path in local_paths:
+            assert_remote_entry(handle_agent, file_path, False)
+            assert_entry_state(handle_agent, file_path, 0, 1, '')
+
+        for file_path in sent_paths:
+            assert_agent_file(handle_agent, file_path, content)
+
+
+@pytest.mark.usefixtures('handle_server')
+@pytest.mark.parametrize('handle_agent', ['tests/data/access_config.json'], indirect=True)
+class TestS3AgentClassAccessRules:
+
+
+    def test_not_accessed_for(self, handle_agent):
+        ### GIVEN ###
+        read_file_path = 'read_file.txt'
+        idle_file_path = 'idle_file.txt'
+        content = 'Hello world'
+
+        create_file(read_file_path, content)
+        create_file(idle_file_path, content)
+
+        ### WHEN ###
+        # Reading the file through the mountpoint keeps it accessed
+        for _ in range(6):
+            with open(f'{FILESYSTEM_PATH}/{read_file_path}') as file:
+                assert file.readlines()[0] == content
+            time.sleep(1)
+
+        ### THEN ###
+        assert_remote_entry(handle_agent, read_file_path, False)
+        assert_entry_state(handle_agent, read_file_path, 0, 1, '')
+        assert_agent_file(handle_agent, idle_file_path, content)
+
+        # Sent once it is left alone
+        time.sleep(5)
+        assert_agent_file(handle_agent, read_file_path, content)
+
+
+@pytest.mark.usefixtures('handle_server')
+@pytest.mark.parametrize('handle_agent', ['tests/data/owner_config.json'], indirect=True)
+class TestS3AgentClassOwnerRules:
+
+
+    def test_user_is(self, handle_agent):
+        ### GIVEN ###
+        owned_file_path = 'owned_file.txt'
+        other_file_path = 'other_file.txt'
+        content = 'Hello world'
+
+        create_file(owned_file_path, content)
+        create_file(other_file_path, content)
+
+        ### WHEN ###
+        nobody = pwd.getpwnam('nobody')
+        os.chown(f'{FILESYSTEM_PATH}/{owned_file_path}', nobody.pw_uid, nobody.pw_gid)
+        time.sleep(3)
+
+        ### THEN ###
+        assert_remote_entry(handle_agent, other_file_path, False)
+        assert_entry_state(handle_agent, other_file_path, 0, 1, '')
+        assert_agent_file(handle_agent, owned_file_path, content)
+
+
+@pytest.mark.usefixtures('handle_server')
+@pytest.mark.parametrize('handle_agent', ['tests/data/condition_config.json'], indirect=True)
+class TestS3AgentClassConditionRules:
+
+
+    def test_composite_condition(self, handle_agent):
+        ### GIVEN ###
+        small_file_path = 'small_condition_file.txt'
+        large_file_path = 'large_condition_file.txt'
+        small_content = 'Hello world'
+        large_content = 'Hello world' * 200
+
+        create_file(small_file_path, small_content)
+        create_file(large_file_path, large_content)
+
+        ### WHEN ###
+        time.sleep(3)
+
+        ### THEN ###
+        assert_remote_entry(handle_agent, small_file_path, False)
+        assert_entry_state(handle_agent, small_file_path, 0, 1, '')
+        assert_agent_file(handle_agent, large_file_path, large_content)
+
+
+    def test_composite_condition_explanation(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'explained_file.txt'
+        create_file(file_path, 'Hello world')
+
+        ### WHEN ###
+        cmd = f'./s3-agent --config-folder={S3_AGENT_PATH} test-rule {FILESYSTEM_PATH} {FILESYSTEM_PATH}/{file_path}'
+
+        ### THEN ###
+        run_command(cmd, stdout='must not be send to remote', code=0)
+        run_command(cmd, stdout='SMALLER_THAN(1Ko) -> true', code=0)
+
+
+@pytest.mark.usefixtures('handle_server')
+@pytest.mark.parametrize('handle_agent', ['tests/data/stream_config.json'], indirect=True)
+class TestS3AgentClassStreamReads:
+
+
+    def test_ranged_read(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'streamed_file.bin'
+        content = os.urandom(20 * 1024 * 1024)
+
+        with open(f'{FILESYSTEM_PATH}/{file_path}', 'wb') as file:
+            file.write(content)
+
+        time.sleep(3)
+        assert_remote_entry(handle_agent, file_path)
+
+        ### WHEN ###
+        with open(f'{FILESYSTEM_PATH}/{file_path}', 'rb') as file:
+            file.seek(10 * 1024 * 1024)
+            data = file.read(1024)
+
+        ### THEN ###
+        assert data == content[10 * 1024 * 1024:10 * 1024 * 1024 + 1024]
+        assert os.getxattr(f'{FILESYSTEM_PATH}/{file_path}', 'user.s3agent.state') == b'remote'
+        assert_remote_entry(handle_agent, file_path)
+
+
+@pytest.mark.usefixtures('handle_server')
+@pytest.mark.parametrize('handle_agent', ['tests/data/prefetch_config.json'], indirect=True)
+class TestS3AgentClassPrefetch:
+
+
+    def test_directory_scan_prefetch(self, handle_agent):
+        ### GIVEN ###
+        file_paths = [f'scanned_folder/scanned_file_{i}.txt' for i in range(5)]
+        content = 'Hello world'
+
+        for file_path in file_paths:
+            create_file(file_path, content)
+        time.sleep(3)
+        for file_path in file_paths:
+            assert_entry_state(handle_agent, file_path, len(content), 0, 'remote')
+
+        ### WHEN ###
+        # Opening the files in name order looks like a scan
+        for file_path in file_paths[:2]:
+            open(f'{FILESYSTEM_PATH}/{file_path}').close()
+        time.sleep(2)
+
+        ### THEN ###
+        # The next two files are fetched, a first block holds the whole small file
+        for file_path in file_paths[:2] + file_paths[4:]:
+            assert_entry_state(handle_agent, file_path, len(content), 0, 'remote')
+        for file_path in file_paths[2:4]:
+            assert_entry_state(handle_agent, file_path, len(content), 1, '')
+
+
+@pytest.mark.usefixtures('handle_server')
+@pytest.mark.parametrize('handle_agent', ['tests/data/cache_config.json'], indirect=True)
+class TestS3AgentClassCache:
+
+
+    def test_recall_keeps_object(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'kept_file.txt'
+        content = 'Hello world'
+
+        create_file(file_path, content)
+        time.sleep(2)
+        assert_remote_entry(handle_agent, file_path)
+
+        ### WHEN ###
+        with open(f'{FILESYSTEM_PATH}/{file_path}') as file:
+            assert file.readlines()[0] == content
+
+        ### THEN ###
+        assert_remote_entry(handle_agent, file_path)
+
+        # Removing the file removes the kept object
+        uuid = get_node_entry(handle_agent, file_path)['uuid']
+        os.remove(f'{FILESYSTEM_PATH}/{file_path}')
+        assert_rclone_file(uuid, False)
+
+
+    def test_clean_file_evicted(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'clean_file.txt'
+        content = 'Hello world'
+
+        create_file(file_path, content)
+        time.sleep(2)
+        checksum = get_node_entry(handle_agent, file_path)['checksum']
+
+        ### WHEN ###
+        with open(f'{FILESYSTEM_PATH}/{file_path}') as file:
+            assert file.readlines()[0] == content
+
+        ### THEN ###
+        assert get_node_entry(handle_agent, file_path)['dirty'] == 0
+        time.sleep(3)
+        assert_entry_state(handle_agent, file_path, len(content), 0, 'remote')
+        assert get_node_entry(handle_agent, file_path)['checksum'] == checksum
+
+
+    def test_modified_file_sent_again(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'dirty_file.txt'
+        content = 'Hello world'
+        new_content = 'Hello new world'
+
+        create_file(file_path, content)
+        time.sleep(2)
+        assert_remote_entry(handle_agent, file_path)
+
+        ### WHEN ###
+        with open(f'{FILESYSTEM_PATH}/{file_path}', 'w') as file:
+            file.write(new_content)
+            file.flush()
+            assert get_node_entry(handle_agent, file_path)['dirty'] == 1
+
+        ### THEN ###
+        time.sleep(3)
+        assert get_node_entry(handle_agent, file_path)['dirty'] == 0
+        assert_entry_state(handle_agent, file_path, len(new_content), 0, 'remote')
+
+        with open(f'{FILESYSTEM_PATH}/{file_path}') as file:
+            assert file.readlines()[0] == new_content
+
+
+@pytest.mark.usefixtures('handle_server')
+@pytest.mark.parametrize('handle_agent', ['tests/data/budget_config.json'], indirect=True)
+class TestS3AgentClassUploadBudget:
+
+
+    def test_files_budget(self, handle_agent):
+        ### GIVEN ###
+        file_paths = ['budget_file_1.txt', 'budget_file_2.txt', 'budget_file_3.txt']
+        content = 'Hello world'
+
+        for file_path in file_paths:
+            create_file(file_path, content)
+
+        ### WHEN ###
+        # The number of remote files each time it changes
+        sent = []
+        cursor = handle_agent
+        deadline = time.time() + 12
+        while time.time() < deadline and (not sent or sent[-1][0] < len(file_paths)):
+            cursor.execute("SELECT COUNT(*) FROM s3_node_tables WHERE local = 0")
+            count = cursor.fetchone()[0]
+            if count != (sent[-1][0] if sent else 0):
+                sent.append((count, time.time()))
+            time.sleep(0.1)
+
+        ### THEN ###
+        # One file per cycle, the cycles run every 2s
+        assert [count for count, _ in sent] == [1, 2, 3]
+        assert all(later - earlier > 1 for (_, earlier), (_, later) in zip(sent, sent[1:]))
+
+        for file_path in file_paths:
+            assert_agent_file(handle_agent, file_path, content)
+
+
+@pytest.mark.usefixtures('handle_server')
+@pytest.mark.parametrize('handle_agent', ['tests/data/pack_config.json'], indirect=True)
+class TestS3AgentClassPack:
+
+
+    def test_small_files_packed(self, handle_agent):
+        ### GIVEN ###
+        file_paths = ['packed_file_1.txt', 'packed_file_2.txt', 'packed_file_3.txt']
+        content = 'Hello world'
+
+        ### WHEN ###
+        for file_path in file_paths:
+            create_file(file_path, content)
+        time.sleep(3)
+
+        ### THEN ###
+        # One pack object holds the three files, one after the other
+        cursor = handle_agent
+        cursor.execute("SELECT COUNT(*) FROM s3_pack_tables")
+        assert cursor.fetchone()[0] == 1
+
+        pack_ids = set()
+        for file_path in file_paths:
+            assert_entry_state(handle_agent, file_path, len(content), 0, 'remote')
+            uuid = get_node_entry(handle_agent, file_path)['uuid']
+            cursor.execute(f"SELECT pack_id, pack_length FROM s3_node_tables WHERE uuid = '{uuid}'")
+            pack_id, pack_length = cursor.fetchone()
+            assert pack_length == len(content)
+            pack_ids.add(pack_id)
+        assert len(pack_ids) == 1 and '' not in pack_ids
+
+        for file_path in file_paths:
+            with open(f'{FILESYSTEM_PATH}/{file_path}') as file:
+                assert file.readlines()[0] == content
+            assert_entry_state(handle_agent, file_path, len(content), 1, '')
+
+
+    def test_large_file_not_packed(self, handle_agent):
+        ### GIVEN ###
+        file_path = 'unpacked_file.txt'
+        content = 'Hello world' * 1024
+
+        ### WHEN ###
+        create_file(file_path, content)
+        time.sleep(3)
+
+        ### THEN ###
+        assert_agent_file(handle_agent, file_path, content)
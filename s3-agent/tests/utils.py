@@ -1,3 +1,4 @@
+import ctypes
 import os
 import sqlite3
 import subprocess
@@ -6,6 +7,7 @@ import time
 
 DEBUG = False
 NB_TRY = 20
+RACE_EXIT_CODE = 66 # Set in GORACE by make test-race
 FILESYSTEM_PATH = './tmp'
 S3_AGENT_PATH = "./config"
 
@@ -45,6 +47,7 @@ def stop_agent(process=None, connection=None, reset_env=True):
     if process is not None:
         process.send_signal(subprocess.signal.SIGTERM)
         process.wait()
+        assert process.returncode != RACE_EXIT_CODE, 'The race detector found a data race, see the agent output'
 
     if reset_env:
         run_command(f'umount tmp')
@@ -58,13 +61,27 @@ def create_file(file_path, content):
         file.write(content)
 
 
+def rename_exchange(first_path, second_path):
+    # Atomically swap two paths with renameat2(RENAME_EXCHANGE), os.rename cannot do it
+    AT_FDCWD, RENAME_EXCHANGE = -100, 2
+    libc = ctypes.CDLL(None, use_errno=True)
+    first_path = f'{FILESYSTEM_PATH}/{first_path}'.encode()
+    second_path = f'{FILESYSTEM_PATH}/{second_path}'.encode()
+    if libc.renameat2(AT_FDCWD, first_path, AT_FDCWD, second_path, RENAME_EXCHANGE) != 0:
+        errno = ctypes.get_errno()
+        raise OSError(errno, os.strerror(errno))
+
+
+# The rows are read by column name, the schema grows with the agent
 def get_rule_entry(cursor):
+    cursor.row_factory = sqlite3.Row
     cursor.execute("SELECT * FROM s3_rule_tables")
     return cursor.fetchone()
 
 
 def get_node_entry(cursor, filename):
-    path = os.path.join(S3_AGENT_PATH[2:], get_rule_entry(cursor)[0], filename)
+    path = os.path.join(S3_AGENT_PATH[2:], get_rule_entry(cursor)['uuid'], filename)
+    cursor.row_factory = sqlite3.Row
     cursor.execute(f"SELECT * FROM s3_node_tables WHERE path = '{path}'")
     return cursor.fetchone()
 
@@ -76,16 +93,23 @@ def assert_rclone_file(file_path, presence=True):
     run_command(cmd, stdout=file_path, code=0, presence=presence)
 
 
+def assert_remote_entry(cursor, file_path, presence=True):
+    # Remote objects are keyed by the UUID of their entry, not by their path
+    entry = get_node_entry(cursor, file_path)
+    assert entry is not None
+    assert_rclone_file(entry['uuid'], presence)
+
+
 def assert_entry_state(cursor, filename, size, Local, server):
     entry = get_node_entry(cursor, filename)
     assert entry is not None
-    assert entry[1] == size, entry
-    assert entry[2] == Local, entry
-    assert entry[4] == server, entry
+    assert entry['size'] == size, dict(entry)
+    assert entry['local'] == Local, dict(entry)
+    assert entry['server'] == server, dict(entry)
 
 
 def assert_agent_file(cursor, file_path, content):
-    assert_rclone_file(file_path)
+    assert_remote_entry(cursor, file_path)
     assert_entry_state(cursor, file_path, len(content), 0, 'remote')
 
     with open(f'{FILESYSTEM_PATH}/{file_path}') as file:
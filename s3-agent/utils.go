@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -24,6 +27,22 @@ func IsDirectory(path string) bool {
 	return err == nil && fo.IsDir()
 }
 
+// Hex MD5 checksum of the content of the file, the one S3 gives for the objects
+func fileMD5(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 func IsRegFile(path string) bool {
 	stat, err := os.Stat(path)
 	if err != nil {
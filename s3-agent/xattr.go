@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Extended attributes handled by the agent, the other ones are passed to the loopback
+const (
+	// "1" keeps the file, or all the files of the directory, local forever
+	// Usage: setfattr -n user.s3agent.pinned -v 1 path
+	pinnedXattr = "user.s3agent.pinned"
+
+	// Writing "offload" or "fetch" starts the action in the background
+	// Reading it returns the progress of the last action (See actions.go)
+	// Usage: setfattr -n user.s3agent.action -v offload path
+	actionXattr = "user.s3agent.action"
+
+	// Read-only attributes describing the offload state of a tracked file
+	// Usage: getfattr -d -m user.s3agent path
+	stateXattr      = "user.s3agent.state"       // "local", "uploading", "remote" or "downloading"
+	serverXattr     = "user.s3agent.server"      // server holding the remote file
+	remoteSizeXattr = "user.s3agent.remote_size" // size of the remote file in bytes
+	objectKeyXattr  = "user.s3agent.object_key"  // key of the object in the bucket
+	uploadedAtXattr = "user.s3agent.uploaded_at" // RFC 3339 date of the upload
+)
+
+// Attributes kept by the agent on the loopback files, hidden from the mountpoint
+const (
+	// UUID of the entry of a file sent to remote, its object key is built from
+	// it so the rebuild command can find the object again
+	uuidXattr = "user.s3agent.uuid"
+
+	// "<pack id>:<offset>:<length>" of a file sent in a pack (See pack.go)
+	packXattr = "user.s3agent.pack"
+)
+
+// Virtual attributes, in the order they are listed
+var stateXattrs = []string{stateXattr, serverXattr, remoteSizeXattr, objectKeyXattr, uploadedAtXattr}
+
+// Attributes that can be neither read nor written through the mountpoint
+var internalXattrs = []string{cachedBlocksXattr, uuidXattr, packXattr}
+
+// Parse the boolean value of an extended attribute
+func parseXattrBool(data []byte) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(strings.TrimRight(string(data), "\x00"))) {
+	case "1", "true", "yes":
+		return true, nil
+	case "0", "false", "no", "":
+		return false, nil
+	default:
+		return false, fmt.Errorf("Invalid boolean value '%s'", string(data))
+	}
+}
+
+// Read a boolean extended attribute of a loopback file, false when the attribute is missing
+func getXattrBool(path, attr string) (bool, error) {
+	value, err := getXattrString(path, attr)
+	if err != nil {
+		return false, err
+	}
+
+	return parseXattrBool([]byte(value))
+}
+
+// Read a short extended attribute of a loopback file, empty when the attribute is missing
+func getXattrString(path, attr string) (string, error) {
+	buf := make([]byte, 64)
+	sz, err := unix.Lgetxattr(path, attr, buf)
+	if err == unix.ENODATA {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return string(buf[:sz]), nil
+}
+
+// Keep the UUID of the entry of a file sent to remote on its loopback file
+func setUUIDXattr(path, uuid string) error {
+	return unix.Lsetxattr(path, uuidXattr, []byte(uuid), 0)
+}
+
+// Keep the range of the pack holding a file sent in a pack on its loopback file
+func setPackXattr(path string, entry *S3NodeTable) error {
+	value := fmt.Sprintf("%s:%d:%d", entry.PackID, entry.PackOffset, entry.PackLength)
+	return unix.Lsetxattr(path, packXattr, []byte(value), 0)
+}
+
+// Read the range of the pack holding a file sent in a pack, the pack id is empty when the attribute is missing
+func getPackXattr(path string) (string, int64, int64, error) {
+	value, err := getXattrString(path, packXattr)
+	if err != nil || value == "" {
+		return "", 0, 0, err
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return "", 0, 0, fmt.Errorf("Invalid pack attribute '%s'", value)
+	}
+
+	offset, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	length, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	return parts[0], offset, length, nil
+}
+
+// Copy the extended attributes of a loopback file to another file, but the cached blocks
+// which only describe the content of the source
+func copyXattrs(fromPath, toPath string) error {
+	sz, err := unix.Llistxattr(fromPath, nil)
+	if err != nil || sz == 0 {
+		return err
+	}
+
+	list := make([]byte, sz)
+	if sz, err = unix.Llistxattr(fromPath, list); err != nil {
+		return err
+	}
+
+	for _, attr := range bytes.Split(list[:sz], []byte{0}) {
+		if len(attr) == 0 || string(attr) == cachedBlocksXattr {
+			continue
+		}
+
+		sz, err := unix.Lgetxattr(fromPath, string(attr), nil)
+		if err != nil {
+			return err
+		}
+
+		value := make([]byte, sz)
+		if sz, err = unix.Lgetxattr(fromPath, string(attr), value); err != nil {
+			return err
+		}
+
+		if err := unix.Lsetxattr(toPath, string(attr), value[:sz], 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Copy an attribute value or list into dest, following getxattr(2) and listxattr(2)
+// semantics when dest is too small
+func copyXattr(value []byte, dest []byte) (uint32, syscall.Errno) {
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+
+	return uint32(copy(dest, value)), 0
+}